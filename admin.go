@@ -0,0 +1,221 @@
+package jeff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page sizes for listing sessions through the Admin handler.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// AuditEvent describes a destructive action taken through the Admin handler.
+type AuditEvent struct {
+	// Request is the operator's request, for identifying who took the
+	// action.
+	Request *http.Request
+	// Action is "revoke" for a single session, or "revoke_all" for all the
+	// sessions of a key.
+	Action string
+	Key    []byte
+	// SessionID is the ID of the revoked session, or empty for "revoke_all".
+	SessionID string
+	// Err is the error the action failed with, if any.
+	Err error
+}
+
+// adminSession describes a session as listed by the Admin handler.
+type adminSession struct {
+	device
+	Meta []byte `json:"meta,omitempty"`
+}
+
+type adminList struct {
+	Key        string         `json:"key"`
+	Total      int            `json:"total"`
+	Sessions   []adminSession `json:"sessions"`
+	NextOffset int            `json:"next_offset,omitempty"`
+}
+
+type adminCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Admin returns a handler for operators to inspect and revoke the sessions of
+// any key, without access to the backend.  It serves the following routes,
+// with keys path-escaped:
+//
+//	GET    /keys/{key}/sessions       list unexpired sessions, newest first
+//	DELETE /keys/{key}/sessions       revoke all sessions for the key
+//	DELETE /keys/{key}/sessions/{id}  revoke the session with the given ID
+//	GET    /keys/{key}/count          count unexpired sessions
+//
+// Lists are paginated with the limit (default 50, at most 500) and offset
+// query parameters, and carry next_offset while more sessions remain.
+//
+// authorize is called on every request, which is rejected with 403 Forbidden
+// unless it returns true.  It must not be nil.  audit, if not nil, is called
+// after every revocation, whether or not it succeeded.  Mount the handler
+// with its prefix stripped:
+//
+//	admin := j.Admin(isOperator, logAudit)
+//	mux.Handle("/admin/sessions/", http.StripPrefix("/admin/sessions", admin))
+func (j *Jeff) Admin(authorize func(*http.Request) bool, audit func(AuditEvent)) http.Handler {
+	if authorize == nil {
+		panic("jeff: Admin requires an authorization hook")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if !authorize(r) {
+			writeProblem(w, http.StatusForbidden, "")
+			return
+		}
+		key, rest, ok := adminRoute(r.URL)
+		if !ok {
+			writeProblem(w, http.StatusNotFound, "")
+			return
+		}
+		var allow string
+		switch {
+		case len(rest) == 1 && rest[0] == "count":
+			allow = "GET"
+			if r.Method == http.MethodGet {
+				j.adminCount(w, r, key)
+				return
+			}
+		case len(rest) == 1 && rest[0] == "sessions":
+			allow = "GET, DELETE"
+			switch r.Method {
+			case http.MethodGet:
+				j.adminList(w, r, key)
+				return
+			case http.MethodDelete:
+				err := j.clear(r.Context(), key)
+				audited(w, audit, AuditEvent{Request: r, Action: "revoke_all", Key: key, Err: err})
+				return
+			}
+		case len(rest) == 2 && rest[0] == "sessions":
+			allow = "DELETE"
+			if r.Method == http.MethodDelete {
+				err := j.revokeID(r.Context(), key, rest[1])
+				audited(w, audit, AuditEvent{Request: r, Action: "revoke", Key: key, SessionID: rest[1], Err: err})
+				return
+			}
+		default:
+			writeProblem(w, http.StatusNotFound, "")
+			return
+		}
+		w.Header().Set("Allow", allow)
+		writeProblem(w, http.StatusMethodNotAllowed, "")
+	})
+}
+
+// adminRoute splits a path of the form /keys/{key}/... into the unescaped
+// key and the remaining segments.
+func adminRoute(u *url.URL) ([]byte, []string, bool) {
+	parts := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	if len(parts) < 3 || parts[0] != "keys" {
+		return nil, nil, false
+	}
+	key, err := url.PathUnescape(parts[1])
+	if err != nil || key == "" {
+		return nil, nil, false
+	}
+	return []byte(key), parts[2:], true
+}
+
+func (j *Jeff) adminList(w http.ResponseWriter, r *http.Request, key []byte) {
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 {
+		writeProblem(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, http.StatusBadRequest, "invalid offset")
+		return
+	}
+	sl, err := j.load(r.Context(), key)
+	if err != nil {
+		writeProblem(w, http.StatusServiceUnavailable, "storage error")
+		return
+	}
+	sl = prune(sl)
+	sort.SliceStable(sl, func(a, b int) bool {
+		return sl[a].Created.After(sl[b].Created)
+	})
+	list := adminList{Key: string(key), Total: len(sl), Sessions: []adminSession{}}
+	// offset may be anything up to the largest int, so it's never added to.
+	for i := offset; i < len(sl) && i-offset < limit; i++ {
+		list.Sessions = append(list.Sessions, adminSession{device: describe(sl[i]), Meta: sl[i].Meta})
+	}
+	if offset < len(sl) && limit < len(sl)-offset {
+		list.NextOffset = offset + limit
+	}
+	writeJSON(w, list)
+}
+
+func (j *Jeff) adminCount(w http.ResponseWriter, r *http.Request, key []byte) {
+	sl, err := j.load(r.Context(), key)
+	if err != nil {
+		writeProblem(w, http.StatusServiceUnavailable, "storage error")
+		return
+	}
+	writeJSON(w, adminCount{Key: string(key), Count: len(prune(sl))})
+}
+
+// revokeID revokes the unexpired session for key with the given ID.
+func (j *Jeff) revokeID(ctx context.Context, key []byte, id string) error {
+	sl, err := j.load(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, s := range prune(sl) {
+		if s.ID() == id {
+			return j.clear(ctx, key, s.Token)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// audited reports the outcome of a revocation to the audit hook and the
+// client.
+func audited(w http.ResponseWriter, audit func(AuditEvent), e AuditEvent) {
+	if audit != nil {
+		audit(e)
+	}
+	switch {
+	case errors.Is(e.Err, ErrSessionNotFound):
+		writeProblem(w, http.StatusNotFound, "session not found")
+	case e.Err != nil:
+		writeProblem(w, http.StatusServiceUnavailable, "storage error")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	json.NewEncoder(w).Encode(v)
+}
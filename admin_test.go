@@ -0,0 +1,113 @@
+package jeff_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type adminList struct {
+	Key      string `json:"key"`
+	Total    int    `json:"total"`
+	Sessions []struct {
+		ID   string `json:"id"`
+		Meta []byte `json:"meta"`
+	} `json:"sessions"`
+	NextOffset int `json:"next_offset"`
+}
+
+func adminRequest(h http.Handler, method, path string, operator bool) *http.Response {
+	req := httptest.NewRequest(method, "http://example.com/admin"+path, nil)
+	if operator {
+		req.Header.Set("X-Operator", "carol")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	j := jeff.New(memory.New())
+	key := []byte("alice/ops@example.com")
+	for i := 0; i < 5; i++ {
+		require.NoError(t, j.Set(ctx, httptest.NewRecorder(), key, []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, j.Set(ctx, httptest.NewRecorder(), email))
+
+	var events []jeff.AuditEvent
+	authorize := func(r *http.Request) bool { return r.Header.Get("X-Operator") != "" }
+	audit := func(e jeff.AuditEvent) { events = append(events, e) }
+	h := http.StripPrefix("/admin", j.Admin(authorize, audit))
+	path := "/keys/alice%2Fops@example.com"
+
+	resp := adminRequest(h, "GET", path+"/sessions", false)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "unauthorized requests should be rejected")
+
+	resp = adminRequest(h, "GET", path+"/count", true)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var count struct{ Count int }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&count))
+	assert.Equal(t, 5, count.Count)
+
+	var list adminList
+	resp = adminRequest(h, "GET", path+"/sessions?limit=2&offset=2", true)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, string(key), list.Key)
+	assert.Equal(t, 5, list.Total)
+	assert.Equal(t, 2, len(list.Sessions))
+	assert.Equal(t, 4, list.NextOffset)
+
+	var past adminList
+	resp = adminRequest(h, "GET", path+"/sessions?limit=500&offset=9223372036854775807", true)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&past))
+	assert.Equal(t, 0, len(past.Sessions), "offsets past the end should give an empty page")
+	assert.Equal(t, 0, past.NextOffset, "offsets past the end shouldn't have a next page")
+
+	resp = adminRequest(h, "GET", path+"/sessions?limit=x", true)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = adminRequest(h, "POST", path+"/sessions", true)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, DELETE", resp.Header.Get("Allow"))
+	resp = adminRequest(h, "GET", "/users", true)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	id := list.Sessions[0].ID
+	resp = adminRequest(h, "DELETE", path+"/sessions/"+id, true)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = adminRequest(h, "DELETE", path+"/sessions/"+id, true)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "revoked sessions can't be revoked again")
+	sl, err := j.SessionsForKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(sl))
+
+	resp = adminRequest(h, "DELETE", path+"/sessions", true)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	sl, err = j.SessionsForKey(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(sl))
+	sl, err = j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl), "other keys should be untouched")
+
+	require.Equal(t, 3, len(events))
+	assert.Equal(t, "revoke", events[0].Action)
+	assert.Equal(t, key, events[0].Key)
+	assert.Equal(t, id, events[0].SessionID)
+	assert.Equal(t, "carol", events[0].Request.Header.Get("X-Operator"))
+	assert.NoError(t, events[0].Err)
+	assert.Equal(t, jeff.ErrSessionNotFound, events[1].Err)
+	assert.Equal(t, "revoke_all", events[2].Action)
+
+	assert.Panics(t, func() { j.Admin(nil, nil) })
+}
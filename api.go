@@ -0,0 +1,133 @@
+package jeff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+type failureMode int
+
+const (
+	redirectMode failureMode = iota
+	apiMode
+	negotiateMode
+)
+
+// API makes Wrap respond to failed authentication with 401 Unauthorized and a
+// JSON problem body (RFC 7807) instead of calling the redirect handler.  This
+// suits APIs called from XHR or native clients, which would otherwise follow
+// the redirect silently.  Backend failures get 503 Service Unavailable so
+// clients don't mistake them for being logged out, and requests rejected by
+// CSRF or CheckOrigin get 403 Forbidden.
+func API(j *Jeff) {
+	j.mode = apiMode
+}
+
+// Negotiate makes Wrap choose how to respond to failed authentication for
+// each request.  Requests which accept HTML, like browser navigation, go to the
+// redirect handler.  All others get the same response as with API.
+func Negotiate(j *Jeff) {
+	j.mode = negotiateMode
+}
+
+// WrapAPI wraps the given handler, authenticating this route and responding
+// as configured by API if the session is invalid, regardless of the mode set
+// on Jeff.
+func (j *Jeff) WrapAPI(wrap http.Handler) http.Handler {
+	return j.wrap(http.HandlerFunc(j.unauthorized), wrap)
+}
+
+// WrapAPIFunc wraps the given handler, authenticating this route and
+// responding as configured by API if the session is invalid, regardless of
+// the mode set on Jeff.
+func (j *Jeff) WrapAPIFunc(wrap http.HandlerFunc) http.HandlerFunc {
+	return j.wrap(http.HandlerFunc(j.unauthorized), wrap).ServeHTTP
+}
+
+// failure returns the handler Wrap calls when authentication fails.
+func (j *Jeff) failure() http.Handler {
+	switch j.mode {
+	case apiMode:
+		return http.HandlerFunc(j.unauthorized)
+	case negotiateMode:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if acceptsHTML(r) {
+				j.redir.ServeHTTP(w, r)
+			} else {
+				j.unauthorized(w, r)
+			}
+		})
+	}
+	return j.redir
+}
+
+// problem is the JSON body of an API error response, as described in
+// RFC 7807.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// unauthorized writes the API response for the failure reason on the request.
+func (j *Jeff) unauthorized(w http.ResponseWriter, r *http.Request) {
+	status, detail := http.StatusUnauthorized, ""
+	err := FailureReason(r.Context())
+	switch {
+	case errors.Is(err, ErrStorage):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrCSRF), errors.Is(err, ErrCrossSite):
+		status = http.StatusForbidden
+	}
+	// Only describe failures in terms of our own errors, since the wrapped
+	// ones may reveal details of the backend.
+	for _, e := range []error{
+		ErrNoCookie, ErrMalformedCookie, ErrInvalidEncoding, ErrSessionNotFound,
+		ErrSessionExpired, ErrSessionInvalidated, ErrTokenReused, ErrStorage,
+		ErrCSRF, ErrCrossSite,
+	} {
+		if errors.Is(err, e) {
+			detail = strings.TrimPrefix(e.Error(), "jeff: ")
+			break
+		}
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Cookie cookie-name=%q", j.cookieName))
+		if j.bearer {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+		}
+	}
+	writeProblem(w, status, detail)
+}
+
+// writeProblem writes a JSON problem response with the given status.
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// acceptsHTML reports whether the request's Accept header lists HTML.
+func acceptsHTML(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if t == "text/html" || t == "application/xhtml+xml" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package jeff_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+func request(h http.Handler, accept string) *http.Response {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func assertProblem(t *testing.T, resp *http.Response, status int) {
+	assert.Equal(t, status, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	var p problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+	assert.Equal(t, status, p.Status)
+	assert.Equal(t, http.StatusText(status), p.Title)
+	assert.NotEmpty(t, p.Detail, "problem should describe the failure")
+}
+
+func TestAPI(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.Redirect(redir), jeff.API)
+	h := j.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	resp := request(h, "text/html")
+	assertProblem(t, resp, http.StatusUnauthorized)
+	assert.Equal(t, `Cookie cookie-name="_gosession"`, resp.Header.Get("WWW-Authenticate"))
+
+	t.Run("storage", func(t *testing.T) {
+		j := jeff.New(failStore{}, jeff.API)
+		h := j.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "_gosession", Value: "a2V5::token"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		resp := w.Result()
+		assertProblem(t, resp, http.StatusServiceUnavailable)
+		assert.Empty(t, resp.Header.Get("WWW-Authenticate"))
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.Redirect(redir), jeff.Negotiate)
+	h := j.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, accept := range []string{
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"application/xhtml+xml",
+	} {
+		resp := request(h, accept)
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "browsers should be redirected")
+		assert.Equal(t, "/login", resp.Header.Get("Location"))
+	}
+	for _, accept := range []string{"", "*/*", "application/json", "text/html;q=0, application/json"} {
+		resp := request(h, accept)
+		assertProblem(t, resp, http.StatusUnauthorized)
+	}
+}
+
+func TestWrapAPI(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.Redirect(redir))
+	h := j.WrapAPIFunc(func(http.ResponseWriter, *http.Request) {})
+	assertProblem(t, request(h, "text/html"), http.StatusUnauthorized)
+
+	h = j.WrapFunc(func(http.ResponseWriter, *http.Request) {})
+	assert.Equal(t, http.StatusFound, request(h, "application/json").StatusCode, "Wrap should still redirect")
+}
@@ -0,0 +1,215 @@
+package bolt_store
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var now = func() time.Time {
+	return time.Now()
+}
+
+// bucket is the bbolt bucket sessions are stored in.
+var bucket = []byte("jeff")
+
+// Store satisfies the jeff.Storage interface.  Values are stored prefixed
+// with their expiration, as nanoseconds since the epoch in 8 big-endian bytes.
+//
+// Every write is a bbolt transaction, which is synced to disk before it
+// returns, so sessions survive crashes and restarts.
+type Store struct {
+	db    *bbolt.DB
+	owned bool
+	every time.Duration
+
+	close sync.Once
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Open opens the bbolt database at path, creating it if needed, and returns a
+// Storage for jeff backed by it.  The database is closed by Close.  Only one
+// process can have a database open at a time.
+func Open(path string, opts ...func(*Store)) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s, err := New(db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.owned = true
+	return s, nil
+}
+
+// New initializes a new bbolt Storage for jeff in an already open database,
+// for sharing it with the application.  Close leaves the database open.
+func New(db *bbolt.DB, opts ...func(*Store)) (*Store, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		db:    db,
+		every: 10 * time.Minute,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	go s.sweeper()
+	return s, nil
+}
+
+// SweepEvery sets how often expired sessions are deleted in the background.
+// Their pages in the file are then reused for new sessions, keeping the file
+// from growing indefinitely.  It defaults to 10 minutes, and 0 disables it.
+func SweepEvery(d time.Duration) func(*Store) {
+	return func(s *Store) {
+		s.every = d
+	}
+}
+
+// Close stops the background sweeper and, if the database was opened by Open,
+// closes it.
+func (s *Store) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.stop)
+		<-s.done
+		if s.owned {
+			err = s.db.Close()
+		}
+	})
+	return err
+}
+
+func (s *Store) sweeper() {
+	defer close(s.done)
+	if s.every == 0 {
+		return
+	}
+	t := time.NewTicker(s.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			// A failed sweep is retried on the next tick.
+			s.Sweep()
+		}
+	}
+}
+
+// Sweep deletes the expired sessions, returning how many there were.
+func (s *Store) Sweep() (int, error) {
+	var n int
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if _, ok := decode(v); !ok {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Store satisfies the jeff.Store.Store method
+func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, encode(value, exp))
+	})
+}
+
+// Fetch satisfies the jeff.Store.Fetch method
+func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if v, ok := decode(tx.Bucket(bucket).Get(key)); ok {
+			// Values are only valid for the life of the transaction.
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Delete satisfies the jeff.Store.Delete method
+func (s *Store) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// Update satisfies the jeff.Updater method.  bbolt allows one read-write
+// transaction at a time, so fn is applied atomically.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		cur, ok := decode(b.Get(key))
+		if ok {
+			// fn must not hold on to memory owned by the transaction.
+			cur = append([]byte{}, cur...)
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return b.Delete(key)
+		}
+		return b.Put(key, encode(value, exp))
+	})
+}
+
+func encode(value []byte, exp time.Time) []byte {
+	b := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(b, uint64(exp.UnixNano()))
+	copy(b[8:], value)
+	return b
+}
+
+// decode returns the value stored in b, and false if it's missing or has
+// expired.
+func decode(b []byte) ([]byte, bool) {
+	if len(b) < 8 || int64(binary.BigEndian.Uint64(b)) <= now().UnixNano() {
+		return nil, false
+	}
+	return b[8:], true
+}
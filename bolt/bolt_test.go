@@ -0,0 +1,72 @@
+package bolt_store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt_store "github.com/abraithwaite/jeff/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestPersistence(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "jeff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.db")
+
+	str, err := bolt_store.Open(path)
+	require.NoError(t, err)
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Second)))
+	require.NoError(t, str.Store(ctx, []byte("new"), []byte("value"), time.Now().Add(time.Hour)))
+	require.NoError(t, str.Close())
+	require.NoError(t, str.Close(), "closing twice should be a no-op")
+
+	str, err = bolt_store.Open(path, bolt_store.SweepEvery(0))
+	require.NoError(t, err)
+	defer str.Close()
+	v, err := str.Fetch(ctx, []byte("new"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), v, "sessions should survive reopening")
+	v, err = str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, v, "expired sessions shouldn't be fetched")
+
+	n, err := str.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	v, err = str.Fetch(ctx, []byte("new"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), v, "unexpired sessions should be kept")
+}
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "jeff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := bbolt.Open(filepath.Join(dir, "sessions.db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	str, err := bolt_store.New(db, bolt_store.SweepEvery(10*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Second)))
+	assert.Eventually(t, func() bool {
+		var found bool
+		db.View(func(tx *bbolt.Tx) error {
+			found = tx.Bucket([]byte("jeff")).Get([]byte("old")) != nil
+			return nil
+		})
+		return !found
+	}, time.Second, 10*time.Millisecond, "sweeper should delete expired sessions")
+
+	require.NoError(t, str.Close())
+	assert.NoError(t, db.View(func(*bbolt.Tx) error { return nil }), "database should be left open")
+}
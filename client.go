@@ -0,0 +1,114 @@
+package jeff
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxUserAgent bounds the User-Agent stored with each session, since it's
+// sent by the client and stored for as long as the session lives.
+const maxUserAgent = 512
+
+var clientKey = contextKey{name: "client"}
+
+// client describes who is starting a session.
+type client struct {
+	ip, userAgent, device string
+}
+
+// TrustedProxies sets the addresses, as IPs or CIDR ranges, of the reverse
+// proxies in front of the server.  The client IP recorded with a session is
+// then taken from the X-Forwarded-For header of requests arriving through
+// them, as the address which the nearest trusted proxy received the request
+// from.  Without it, X-Forwarded-For is ignored since any client can set it.
+// TrustedProxies panics if given an invalid address.
+func TrustedProxies(addrs ...string) func(*Jeff) {
+	nets := make([]*net.IPNet, len(addrs))
+	for i, a := range addrs {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			panic("jeff: invalid trusted proxy: " + err.Error())
+		}
+		nets[i] = n
+	}
+	return func(j *Jeff) {
+		j.proxies = nets
+	}
+}
+
+// WithClient returns the request's context carrying the client's IP and
+// User-Agent, for Set and Issue to record with the session.  Public and Wrap
+// do this already, so it's only needed by login handlers which aren't wrapped
+// by either:
+//
+//	err := j.Set(j.WithClient(r), w, key)
+func (j *Jeff) WithClient(r *http.Request) context.Context {
+	c := client{ip: j.clientIP(r), userAgent: r.UserAgent()}
+	if len(c.userAgent) > maxUserAgent {
+		c.userAgent = c.userAgent[:maxUserAgent]
+	}
+	if prev, ok := r.Context().Value(clientKey).(client); ok {
+		c.device = prev.device
+	}
+	return context.WithValue(r.Context(), clientKey, c)
+}
+
+// WithDevice returns a context carrying a label for the client's device, such
+// as one chosen by the user, for Set and Issue to record with the session.
+func WithDevice(ctx context.Context, label string) context.Context {
+	c, _ := ctx.Value(clientKey).(client)
+	c.device = label
+	return context.WithValue(ctx, clientKey, c)
+}
+
+// clientIP returns the IP of the client making the request, looking past the
+// trusted proxies.
+func (j *Jeff) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !j.trustedProxy(ip) {
+		return ip
+	}
+	// Each proxy appends the address it received the request from, so the
+	// rightmost address not belonging to one of ours is the client.  Anything
+	// left of it could have been made up by the client.
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !j.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (j *Jeff) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range j.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package jeff_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestClientMetadata(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	defer jeff.SetTime(time.Now)
+
+	j := jeff.New(memory.New())
+	r := http.NewServeMux()
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		ctx := jeff.WithDevice(j.WithClient(r), "work laptop")
+		require.NoError(t, j.Set(ctx, w, []byte("alice")))
+	})
+	r.Handle("/public", j.Public(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, j.Set(r.Context(), w, []byte("bob")))
+	})))
+
+	for _, path := range []string{"/login", "/public"} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = "203.0.113.4:5678"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	sl, err := j.SessionsForKey(context.Background(), []byte("alice"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sl))
+	assert.WithinDuration(t, rec, sl[0].Created, 0)
+	assert.Equal(t, "203.0.113.4", sl[0].IP)
+	assert.Equal(t, "Mozilla/5.0", sl[0].UserAgent)
+	assert.Equal(t, "work laptop", sl[0].Device)
+
+	sl, err = j.SessionsForKey(context.Background(), []byte("bob"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sl))
+	assert.Equal(t, "203.0.113.4", sl[0].IP)
+	assert.Equal(t, "Mozilla/5.0", sl[0].UserAgent)
+	assert.Equal(t, "", sl[0].Device)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		proxies []string
+		remote  string
+		xff     []string
+		ip      string
+	}{
+		{"no proxies", nil, "198.51.100.1:80", []string{"203.0.113.4"}, "198.51.100.1"},
+		{"untrusted remote", []string{"10.0.0.0/8"}, "198.51.100.1:80", []string{"203.0.113.4"}, "198.51.100.1"},
+		{"one proxy", []string{"10.0.0.1"}, "10.0.0.1:80", []string{"203.0.113.4"}, "203.0.113.4"},
+		{"spoofed", []string{"10.0.0.0/8"}, "10.0.0.1:80", []string{"1.2.3.4, 203.0.113.4, 10.0.0.2"}, "203.0.113.4"},
+		{"multiple headers", []string{"10.0.0.0/8"}, "10.0.0.1:80", []string{"1.2.3.4", "203.0.113.4"}, "203.0.113.4"},
+		{"all trusted", []string{"10.0.0.0/8"}, "10.0.0.1:80", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage", []string{"10.0.0.0/8"}, "10.0.0.1:80", []string{"203.0.113.4, bogus"}, "10.0.0.1"},
+		{"ipv6", []string{"fd00::/8"}, "[fd00::1]:80", []string{"2001:db8::1"}, "2001:db8::1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			j := jeff.New(memory.New(), jeff.TrustedProxies(tc.proxies...))
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tc.remote
+			for _, h := range tc.xff {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			require.NoError(t, j.Set(j.WithClient(req), httptest.NewRecorder(), []byte("alice")))
+			sl, err := j.SessionsForKey(context.Background(), []byte("alice"))
+			require.NoError(t, err)
+			require.Equal(t, 1, len(sl))
+			assert.Equal(t, tc.ip, sl[0].IP)
+		})
+	}
+	assert.Panics(t, func() { jeff.TrustedProxies("10.0.0.0/33") })
+}
+
+func TestLegacySessionDecode(t *testing.T) {
+	// A session as stored before client metadata was recorded.
+	exp := time.Now().Add(time.Hour)
+	b := msgp.AppendArrayHeader(nil, 1)
+	b = msgp.AppendMapHeader(b, 4)
+	b = msgp.AppendString(b, "key")
+	b = msgp.AppendBytes(b, []byte("alice"))
+	b = msgp.AppendString(b, "token")
+	b = msgp.AppendBytes(b, []byte("secret"))
+	b = msgp.AppendString(b, "meta")
+	b = msgp.AppendBytes(b, nil)
+	b = msgp.AppendString(b, "exp")
+	b = msgp.AppendTime(b, exp)
+
+	var sl jeff.SessionList
+	_, err := sl.UnmarshalMsg(b)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sl))
+	assert.Equal(t, []byte("alice"), sl[0].Key)
+	assert.WithinDuration(t, exp, sl[0].Exp, 0)
+	assert.True(t, sl[0].Created.IsZero())
+	assert.Equal(t, "", sl[0].IP)
+	assert.Equal(t, "", sl[0].UserAgent)
+	assert.Equal(t, "", sl[0].Device)
+}
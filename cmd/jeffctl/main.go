@@ -0,0 +1,408 @@
+// Command jeffctl inspects and revokes sessions stored by jeff, for use during
+// incidents and debugging.
+//
+// Usage:
+//
+//	jeffctl [flags] show [-json] <key>
+//	jeffctl [flags] revoke <key> <id or token>...
+//	jeffctl [flags] revoke -all <key>
+//	jeffctl [flags] extend [-id id]... <key> <duration>
+//	jeffctl [flags] invalidate [-before time] <key>
+//	jeffctl [flags] invalidate [-before time] -all-keys
+//	jeffctl [flags] rename <old key> <new key>
+//	jeffctl [flags] decode <cookie value>
+//
+// Sessions are referred to by the IDs show prints, or by their tokens.  The
+// -hash-key flag must match the MapKey(HashKey(prefix)) option of the
+// application, if it uses one.  invalidate only has an effect if the
+// application sets the Epochs option.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	bolt_store "github.com/abraithwaite/jeff/bolt"
+	dynamodb_store "github.com/abraithwaite/jeff/dynamodb"
+	file_store "github.com/abraithwaite/jeff/file"
+	memcache_store "github.com/abraithwaite/jeff/memcache"
+	mongo_store "github.com/abraithwaite/jeff/mongo"
+	redis_store "github.com/abraithwaite/jeff/redis"
+	sql_store "github.com/abraithwaite/jeff/sql"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gomodule/redigo/redis"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// backends maps the names accepted by -backend to their default address and
+// a constructor for the Storage.
+var backends = map[string]struct {
+	addr string
+	open func(addr string) (jeff.Storage, error)
+}{
+	"redis": {"localhost:6379", func(addr string) (jeff.Storage, error) {
+		return redis_store.New(&redis.Pool{
+			Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		}), nil
+	}},
+	"memcache": {"localhost:11211", func(addr string) (jeff.Storage, error) {
+		return memcache_store.New(memcache.New(strings.Split(addr, ",")...)), nil
+	}},
+	// The region and credentials come from the usual AWS environment
+	// variables and shared configuration.
+	"dynamodb": {"jeff_sessions", func(table string) (jeff.Storage, error) {
+		sess, err := awssession.NewSessionWithOptions(awssession.Options{SharedConfigState: awssession.SharedConfigEnable})
+		if err != nil {
+			return nil, err
+		}
+		return dynamodb_store.New(dynamodb.New(sess), table), nil
+	}},
+	// The path of the URI names the collection as database.collection.
+	"mongo": {"mongodb://localhost:27017/jeff.sessions", func(addr string) (jeff.Storage, error) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		ns := strings.SplitN(strings.TrimPrefix(u.Path, "/"), ".", 2)
+		if len(ns) != 2 {
+			return nil, fmt.Errorf("no database.collection in %q", addr)
+		}
+		u.Path = "/"
+		client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(u.String()))
+		if err != nil {
+			return nil, err
+		}
+		return mongo_store.New(client.Database(ns[0]).Collection(ns[1])), nil
+	}},
+	"bolt": {"sessions.db", func(addr string) (jeff.Storage, error) {
+		return bolt_store.Open(addr, bolt_store.SweepEvery(0))
+	}},
+	"file": {"sessions", func(addr string) (jeff.Storage, error) {
+		return file_store.New(addr, file_store.SweepEvery(0))
+	}},
+	"sqlite": {"sessions.db", func(addr string) (jeff.Storage, error) {
+		db, err := sql.Open("sqlite3", addr)
+		if err != nil {
+			return nil, err
+		}
+		return sql_store.New(db, sql_store.SQLite), nil
+	}},
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	flag.Usage = usage
+	backend := flag.String("backend", "redis", "storage backend: redis, memcache, dynamodb, mongo, bolt, file or sqlite")
+	addr := flag.String("addr", "", "address of the backend, table for dynamodb, URI for mongo, or path for bolt, file and sqlite (default depends on -backend)")
+	hashKey := flag.String("hash-key", "", "prefix given to MapKey(HashKey(prefix)), if used")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for backend operations")
+	flag.Parse()
+
+	b, ok := backends[*backend]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "jeffctl: unknown backend %q\n", *backend)
+		os.Exit(2)
+	}
+	if *addr == "" {
+		*addr = b.addr
+	}
+	str, err := b.open(*addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jeffctl: %v\n", err)
+		os.Exit(1)
+	}
+	// Epochs only affects authenticating requests, which jeffctl doesn't do,
+	// but lets invalidate write them.
+	opts := []func(*jeff.Jeff){jeff.Epochs}
+	if *hashKey != "" {
+		opts = append(opts, jeff.MapKey(jeff.HashKey(*hashKey)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	err = run(ctx, jeff.New(str, opts...), os.Stdout, flag.Args())
+	if errors.Is(err, errUsage) {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "jeffctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+  jeffctl [flags] show [-json] <key>
+  jeffctl [flags] revoke <key> <id or token>...
+  jeffctl [flags] revoke -all <key>
+  jeffctl [flags] extend [-id id]... <key> <duration>
+  jeffctl [flags] invalidate [-before time] <key>
+  jeffctl [flags] invalidate [-before time] -all-keys
+  jeffctl [flags] rename <old key> <new key>
+  jeffctl [flags] decode <cookie value>
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func run(ctx context.Context, j *jeff.Jeff, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	switch args[0] {
+	case "show":
+		asJSON := fs.Bool("json", false, "print JSON instead of a table")
+		if fs.Parse(args[1:]) != nil || fs.NArg() != 1 {
+			return errUsage
+		}
+		return show(ctx, j, w, []byte(fs.Arg(0)), *asJSON)
+	case "revoke":
+		all := fs.Bool("all", false, "revoke every session for the key")
+		if fs.Parse(args[1:]) != nil || fs.NArg() < 1 || *all != (fs.NArg() == 1) {
+			return errUsage
+		}
+		return revoke(ctx, j, w, []byte(fs.Arg(0)), fs.Args()[1:])
+	case "extend":
+		var ids list
+		fs.Var(&ids, "id", "ID or token of a session to extend; all sessions if not given")
+		if fs.Parse(args[1:]) != nil || fs.NArg() != 2 {
+			return errUsage
+		}
+		dur, err := time.ParseDuration(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		return extend(ctx, j, w, []byte(fs.Arg(0)), dur, ids)
+	case "invalidate":
+		before := fs.String("before", "", "invalidate sessions created before this RFC 3339 time (default now)")
+		allKeys := fs.Bool("all-keys", false, "invalidate sessions for every key")
+		if fs.Parse(args[1:]) != nil || *allKeys != (fs.NArg() == 0) || fs.NArg() > 1 {
+			return errUsage
+		}
+		t := time.Now()
+		if *before != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339, *before); err != nil {
+				return err
+			}
+		}
+		return invalidate(ctx, j, w, []byte(fs.Arg(0)), *allKeys, t)
+	case "rename":
+		if len(args) != 3 {
+			return errUsage
+		}
+		if err := j.RenameKey(ctx, []byte(args[1]), []byte(args[2])); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "renamed %q to %q\n", args[1], args[2])
+		return nil
+	case "decode":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return decode(ctx, j, w, args[1])
+	}
+	return errUsage
+}
+
+// session is a session as printed by jeffctl.  Secrets, such as the CSRF
+// secret, are left out.
+type session struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Expired   bool      `json:"expired"`
+	Created   time.Time `json:"created"`
+	Issued    time.Time `json:"issued"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	MaxExpiry time.Time `json:"max_expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Device    string    `json:"device"`
+	Meta      string    `json:"meta"`
+}
+
+func show(ctx context.Context, j *jeff.Jeff, w io.Writer, key []byte, asJSON bool) error {
+	sl, err := j.SessionsForKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	out := make([]session, len(sl))
+	for i, s := range sl {
+		out[i] = session{
+			ID:        s.ID(),
+			Key:       string(s.Key),
+			Expired:   s.Exp.Before(time.Now()),
+			Created:   s.Created,
+			Issued:    s.Issued,
+			LastSeen:  s.LastSeen,
+			Expires:   s.Exp,
+			MaxExpiry: s.MaxExp,
+			IP:        s.IP,
+			UserAgent: s.UserAgent,
+			Device:    s.Device,
+			Meta:      string(s.Meta),
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	if len(out) == 0 {
+		fmt.Fprintf(w, "no sessions for %q\n", key)
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tLAST SEEN\tEXPIRES\tIP\tDEVICE")
+	for _, s := range out {
+		exp := date(s.Expires)
+		if s.Expired {
+			exp += " (expired)"
+		}
+		dev := s.Device
+		if dev == "" {
+			dev = s.UserAgent
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, date(s.Created), date(s.LastSeen), exp, s.IP, dev)
+	}
+	return tw.Flush()
+}
+
+func revoke(ctx context.Context, j *jeff.Jeff, w io.Writer, key []byte, ids []string) error {
+	if len(ids) == 0 {
+		if err := j.Delete(ctx, key); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "revoked all sessions for %q\n", key)
+		return nil
+	}
+	tokens, err := resolve(ctx, j, key, ids)
+	if err != nil {
+		return err
+	}
+	if err := j.Delete(ctx, key, tokens...); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "revoked %s for %q\n", strings.Join(ids, ", "), key)
+	return nil
+}
+
+func extend(ctx context.Context, j *jeff.Jeff, w io.Writer, key []byte, dur time.Duration, ids []string) error {
+	tokens, err := resolve(ctx, j, key, ids)
+	if err != nil {
+		return err
+	}
+	exp := time.Now().Add(dur)
+	if err := j.Extend(ctx, key, exp, tokens...); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "extended sessions for %q until %s\n", key, date(exp))
+	return nil
+}
+
+func invalidate(ctx context.Context, j *jeff.Jeff, w io.Writer, key []byte, allKeys bool, t time.Time) error {
+	if allKeys {
+		if err := j.InvalidateAllBefore(ctx, t); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "invalidated sessions for all keys created before %s\n", date(t))
+		return nil
+	}
+	if err := j.InvalidateBefore(ctx, key, t); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "invalidated sessions for %q created before %s\n", key, date(t))
+	return nil
+}
+
+// resolve maps session IDs, or tokens, to the sessions' stored tokens.  It
+// fails if any of them doesn't match a session, so nothing is changed on the
+// strength of a typo.
+func resolve(ctx context.Context, j *jeff.Jeff, key []byte, ids []string) ([][]byte, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	sl, err := j.SessionsForKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var tokens [][]byte
+	var unmatched []string
+	for _, id := range ids {
+		// Sessions store the SHA-256 digest of their token.
+		sum := sha256.Sum256([]byte(id))
+		found := false
+		for _, s := range sl {
+			if s.ID() == id || bytes.Equal(s.Token, sum[:]) {
+				tokens = append(tokens, s.Token)
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, id)
+		}
+	}
+	if len(unmatched) > 0 {
+		return nil, fmt.Errorf("no session for %q with ID or token %s", key, strings.Join(unmatched, ", "))
+	}
+	return tokens, nil
+}
+
+func decode(ctx context.Context, j *jeff.Jeff, w io.Writer, value string) error {
+	key, tok, err := j.Parse(ctx, value)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "key:   %s\ntoken: %s\n", key, tok)
+	sl, err := j.SessionsForKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	// Sessions store the SHA-256 digest of their token.
+	sum := sha256.Sum256(tok)
+	for _, s := range sl {
+		if bytes.Equal(s.Token, sum[:]) {
+			fmt.Fprintf(w, "id:    %s\n", s.ID())
+			return nil
+		}
+	}
+	fmt.Fprintln(w, "no matching session")
+	return nil
+}
+
+func date(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// list collects the values of a repeated flag.
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(v string) error { *l = append(*l, v); return nil }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var alice = []byte("alice@example.com")
+
+// fixture holds two sessions for alice, as seen by jeffctl and by their
+// clients.
+type fixture struct {
+	j       *jeff.Jeff
+	ids     []string
+	tokens  []string
+	cookies []string
+}
+
+func setup(t *testing.T) fixture {
+	ctx := context.Background()
+	f := fixture{j: jeff.New(memory.New(), jeff.Epochs)}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		require.NoError(t, f.j.Set(ctx, w, alice))
+		value := w.Result().Cookies()[0].Value
+		_, tok, err := f.j.Parse(ctx, value)
+		require.NoError(t, err)
+		f.cookies = append(f.cookies, value)
+		f.tokens = append(f.tokens, string(tok))
+	}
+	sl, err := f.j.SessionsForKey(ctx, alice)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sl))
+	for _, s := range sl {
+		f.ids = append(f.ids, s.ID())
+	}
+	return f
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args func(f fixture) []string
+		// out returns text the output should contain.
+		out func(f fixture) string
+		err string
+		// left is how many of alice's sessions should remain.
+		left  int
+		check func(t *testing.T, f fixture, out string, sl jeff.SessionList)
+	}{
+		{
+			name: "show",
+			args: func(f fixture) []string { return []string{"show", string(alice)} },
+			out:  func(f fixture) string { return "ID  " },
+			left: 2,
+			check: func(t *testing.T, f fixture, out string, _ jeff.SessionList) {
+				for _, id := range f.ids {
+					assert.Contains(t, out, id)
+				}
+			},
+		},
+		{
+			name: "show json",
+			args: func(f fixture) []string { return []string{"show", "-json", string(alice)} },
+			left: 2,
+			check: func(t *testing.T, f fixture, out string, _ jeff.SessionList) {
+				var ss []session
+				require.NoError(t, json.Unmarshal([]byte(out), &ss))
+				require.Equal(t, 2, len(ss))
+				assert.Equal(t, f.ids, []string{ss[0].ID, ss[1].ID})
+				assert.Equal(t, string(alice), ss[0].Key)
+				assert.NotContains(t, out, "csrf", "secrets shouldn't be printed")
+			},
+		},
+		{
+			name: "show no sessions",
+			args: func(f fixture) []string { return []string{"show", "bob@example.com"} },
+			out:  func(f fixture) string { return `no sessions for "bob@example.com"` },
+			left: 2,
+		},
+		{
+			name: "revoke by token",
+			args: func(f fixture) []string { return []string{"revoke", string(alice), f.tokens[0]} },
+			out:  func(f fixture) string { return "revoked" },
+			left: 1,
+			check: func(t *testing.T, f fixture, _ string, sl jeff.SessionList) {
+				assert.Equal(t, f.ids[1], sl[0].ID(), "only the selected session should be revoked")
+			},
+		},
+		{
+			name: "revoke by ID",
+			args: func(f fixture) []string { return []string{"revoke", string(alice), f.ids[1]} },
+			out:  func(f fixture) string { return "revoked " + f.ids[1] },
+			left: 1,
+			check: func(t *testing.T, f fixture, _ string, sl jeff.SessionList) {
+				assert.Equal(t, f.ids[0], sl[0].ID(), "only the selected session should be revoked")
+			},
+		},
+		{
+			name: "revoke unknown",
+			args: func(f fixture) []string { return []string{"revoke", string(alice), f.ids[0], "nope"} },
+			err:  `no session for "alice@example.com" with ID or token nope`,
+			left: 2,
+		},
+		{
+			name: "revoke all",
+			args: func(f fixture) []string { return []string{"revoke", "-all", string(alice)} },
+			out:  func(f fixture) string { return `revoked all sessions for "alice@example.com"` },
+			left: 0,
+		},
+		{
+			name: "revoke all with IDs",
+			args: func(f fixture) []string { return []string{"revoke", "-all", string(alice), f.ids[0]} },
+			err:  errUsage.Error(),
+			left: 2,
+		},
+		{
+			name: "extend",
+			args: func(f fixture) []string { return []string{"extend", "-id", f.ids[0], string(alice), "1h"} },
+			out:  func(f fixture) string { return "extended sessions" },
+			left: 2,
+			check: func(t *testing.T, f fixture, _ string, sl jeff.SessionList) {
+				assert.WithinDuration(t, time.Now().Add(time.Hour), sl[0].Exp, time.Minute, "selected session should be extended")
+				assert.True(t, sl[1].Exp.After(time.Now().Add(24*time.Hour)), "other sessions should be untouched")
+			},
+		},
+		{
+			name: "decode",
+			args: func(f fixture) []string { return []string{"decode", f.cookies[1]} },
+			out: func(f fixture) string {
+				return "key:   alice@example.com\ntoken: " + f.tokens[1] + "\nid:    " + f.ids[1]
+			},
+			left: 2,
+		},
+		{
+			name: "decode malformed",
+			args: func(f fixture) []string { return []string{"decode", "::token"} },
+			err:  jeff.ErrMalformedCookie.Error(),
+			left: 2,
+		},
+		{
+			name: "no command",
+			args: func(f fixture) []string { return nil },
+			err:  errUsage.Error(),
+			left: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := setup(t)
+			var out bytes.Buffer
+			err := run(ctx, f.j, &out, tc.args(f))
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.True(t, strings.Contains(err.Error(), tc.err), "error %q should contain %q", err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			if tc.out != nil {
+				assert.Contains(t, out.String(), tc.out(f))
+			}
+			sl, err := f.j.SessionsForKey(ctx, alice)
+			require.NoError(t, err)
+			require.Equal(t, tc.left, len(sl))
+			if tc.check != nil {
+				tc.check(t, f, out.String(), sl)
+			}
+		})
+	}
+}
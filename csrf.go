@@ -0,0 +1,145 @@
+package jeff
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// CSRFField is the form field the CSRF middleware reads tokens from.
+const CSRFField = "csrf_token"
+
+// CSRFHeader is the header the CSRF middleware reads tokens from, for
+// requests made by scripts.
+const CSRFHeader = "X-CSRF-Token"
+
+// csrfSize is the length of CSRF secrets in bytes.
+const csrfSize = 32
+
+var csrfKey = contextKey{name: "csrf"}
+
+// CSRF wraps the given handler, rejecting requests with unsafe methods which
+// don't carry a valid CSRF token in the CSRFHeader header or the CSRFField
+// form field.  Rejected requests go to the same handler as failed
+// authentication, with ErrCSRF as the FailureReason.
+//
+// Tokens are bound to the active session, so CSRF must be wrapped by Wrap or
+// Public.  Requests without a session are given a secret in a separate cookie
+// instead, which protects login forms against login CSRF.
+//
+//	mux.Handle("/login", j.Public(j.CSRF(loginHandler)))
+//	mux.Handle("/settings", j.Wrap(j.CSRF(settingsHandler)))
+func (j *Jeff) CSRF(wrap http.Handler) http.Handler {
+	failure := j.failure()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, err := j.csrfSecret(w, r)
+		if err != nil {
+			fail(failure, w, r, err)
+			return
+		}
+		if !safeMethod(r.Method) && !validCSRF(secret, csrfFromRequest(r)) {
+			fail(failure, w, r, ErrCSRF)
+			return
+		}
+		wrap.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey, secret)))
+	})
+}
+
+// CSRFToken returns a CSRF token for the request whose context is given, to
+// be embedded in forms in the CSRFField field or sent by scripts in the
+// CSRFHeader header.  Tokens are masked differently on each call, so they're
+// safe to include in compressed responses.  It returns the empty string if
+// the request has neither passed through CSRF nor has an active session.
+func CSRFToken(ctx context.Context) string {
+	secret, ok := ctx.Value(csrfKey).([]byte)
+	if !ok {
+		secret = ActiveSession(ctx).CSRF
+	}
+	if len(secret) == 0 {
+		return ""
+	}
+	tok := genRandomBytes(2 * len(secret))
+	for i := range secret {
+		tok[len(secret)+i] = tok[i] ^ secret[i]
+	}
+	return encode(tok)
+}
+
+// csrfSecret returns the CSRF secret for the request, from the active session
+// or else from the pre-login cookie, which is set if missing.
+func (j *Jeff) csrfSecret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	s := ActiveSession(r.Context())
+	if len(s.Key) == 0 {
+		return j.preLoginSecret(w, r), nil
+	}
+	if len(s.CSRF) != 0 {
+		return s.CSRF, nil
+	}
+	// Sessions stored by older versions have no secret yet.
+	return j.addCSRF(r.Context(), s)
+}
+
+// addCSRF gives the stored session matching s.Token a CSRF secret, unless a
+// concurrent request already did, and returns it.
+func (j *Jeff) addCSRF(ctx context.Context, s Session) ([]byte, error) {
+	secret := genRandomBytes(csrfSize)
+	var found bool
+	err := j.update(ctx, s.Key, func(sl SessionList) SessionList {
+		_, i := find(sl, s.Token)
+		if found = i >= 0; !found {
+			return sl
+		}
+		if len(sl[i].CSRF) == 0 {
+			sl[i].CSRF = secret
+		}
+		secret = sl[i].CSRF
+		return sl
+	})
+	if err == nil && !found {
+		err = ErrSessionNotFound
+	}
+	return secret, err
+}
+
+func (j *Jeff) preLoginSecret(w http.ResponseWriter, r *http.Request) []byte {
+	name := j.cookieName + "_csrf"
+	if c, err := r.Cookie(name); err == nil {
+		if secret, err := decode(c.Value); err == nil && len(secret) == csrfSize {
+			return secret
+		}
+	}
+	secret := genRandomBytes(csrfSize)
+	c := j.cookie(encode(secret), time.Time{})
+	c.Name = name
+	http.SetCookie(w, c)
+	return secret
+}
+
+func csrfFromRequest(r *http.Request) string {
+	if tok := r.Header.Get(CSRFHeader); tok != "" {
+		return tok
+	}
+	return r.PostFormValue(CSRFField)
+}
+
+// validCSRF reports whether the masked token tok was derived from secret.
+func validCSRF(secret []byte, tok string) bool {
+	b, err := decode(tok)
+	if err != nil || len(b) != 2*len(secret) {
+		return false
+	}
+	unmasked := make([]byte, len(secret))
+	for i := range unmasked {
+		unmasked[i] = b[i] ^ b[len(secret)+i]
+	}
+	return subtle.ConstantTimeCompare(unmasked, secret) == 1
+}
+
+func safeMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package jeff_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func csrfServer(t *testing.T, opts ...func(*jeff.Jeff)) (http.Handler, *error) {
+	var reason error
+	fail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = jeff.FailureReason(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})
+	j := jeff.New(memory.New(), append([]func(*jeff.Jeff){jeff.Redirect(fail)}, opts...)...)
+	s := &server{j: j, t: t}
+	token := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jeff.CSRFToken(r.Context())))
+	})
+	r := http.NewServeMux()
+	r.HandleFunc("/login", s.login)
+	r.Handle("/form", j.Wrap(j.CSRF(token)))
+	r.Handle("/public", j.Public(j.CSRF(token)))
+	r.Handle("/session", j.Wrap(token))
+	return r, &reason
+}
+
+func post(h http.Handler, path string, form url.Values, header string, cookies ...*http.Cookie) *http.Response {
+	req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		req.Header.Set(jeff.CSRFHeader, header)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCSRF(t *testing.T) {
+	h, reason := csrfServer(t)
+	resp := get(h, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+
+	tok := body(t, get(h, "/form", cookie))
+	require.NotEmpty(t, tok, "token should be available on the context")
+	tok2 := body(t, get(h, "/session", cookie))
+	require.NotEmpty(t, tok2, "token should be available from the session")
+	assert.NotEqual(t, tok, tok2, "tokens should be masked differently")
+
+	for _, tc := range []struct {
+		name   string
+		form   string
+		header string
+		status int
+	}{
+		{"form field", tok, "", http.StatusOK},
+		{"header", "", tok2, http.StatusOK},
+		{"missing", "", "", http.StatusTeapot},
+		{"tampered", tok[:len(tok)-2] + "AA", "", http.StatusTeapot},
+		{"garbage", "not a token", "", http.StatusTeapot},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*reason = nil
+			resp := post(h, "/form", url.Values{jeff.CSRFField: {tc.form}}, tc.header, cookie)
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.status != http.StatusOK {
+				assert.Equal(t, jeff.ErrCSRF, *reason)
+			}
+		})
+	}
+
+	t.Run("other session", func(t *testing.T) {
+		other := get(h, "/login", nil).Cookies()[0]
+		resp := post(h, "/form", url.Values{jeff.CSRFField: {tok}}, "", other)
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode, "token should be bound to its session")
+	})
+}
+
+func TestCSRFPreLogin(t *testing.T) {
+	h, reason := csrfServer(t)
+	resp := get(h, "/public", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "pre-login secret should be set")
+	secret := resp.Cookies()[0]
+	assert.Equal(t, "_gosession_csrf", secret.Name)
+	assert.True(t, secret.HttpOnly, "pre-login secret should be HttpOnly")
+	tok := body(t, resp)
+	require.NotEmpty(t, tok)
+
+	resp = post(h, "/public", url.Values{jeff.CSRFField: {tok}}, "", secret)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "pre-login token should be valid")
+	assert.Empty(t, resp.Cookies(), "existing pre-login secret should be kept")
+
+	*reason = nil
+	resp = post(h, "/public", url.Values{jeff.CSRFField: {tok}}, "")
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode, "token without its secret should be rejected")
+	assert.Equal(t, jeff.ErrCSRF, *reason)
+}
+
+func TestCSRFAPI(t *testing.T) {
+	h, _ := csrfServer(t, jeff.API)
+	cookie := get(h, "/login", nil).Cookies()[0]
+	resp := post(h, "/form", nil, "", cookie)
+	assertProblem(t, resp, http.StatusForbidden)
+}
@@ -0,0 +1,181 @@
+package jeff
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// device describes a session as listed by the Devices handler.
+type device struct {
+	ID        string     `json:"id"`
+	Current   bool       `json:"current,omitempty"`
+	Device    string     `json:"device,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Expires   time.Time  `json:"expires"`
+}
+
+type deviceList struct {
+	Sessions  []device `json:"sessions"`
+	CSRFToken string   `json:"csrf_token"`
+}
+
+// Devices returns a handler which lets users see the sessions for their key
+// and revoke the ones they don't recognize.  A GET responds with the
+// unexpired sessions as JSON, the current one first:
+//
+//	{"sessions": [{"id": "...", "current": true, "device": "...",
+//	  "user_agent": "...", "ip": "...", "created": "...",
+//	  "last_seen": "...", "expires": "..."}], "csrf_token": "..."}
+//
+// A POST with a session's ID in the "revoke" form field revokes it, and one
+// with "others" revokes every session but the current one, then responds with
+// the remaining sessions.  Revoking the current session logs the user out and
+// responds with 204 No Content.  The handler is wrapped by Wrap and CSRF, so
+// POSTs must carry the token in csrf_token.
+//
+//	mux.Handle("/account/devices", j.Devices())
+func (j *Jeff) Devices() http.Handler {
+	return j.devices(false)
+}
+
+// DevicesHTML is like Devices, but responds to browsers with a minimal HTML
+// page listing the sessions, with buttons to revoke them.  Other clients
+// still get JSON.
+func (j *Jeff) DevicesHTML() http.Handler {
+	return j.devices(true)
+}
+
+func (j *Jeff) devices(page bool) http.Handler {
+	return j.Wrap(j.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		html := page && acceptsHTML(r)
+		w.Header().Set("Cache-Control", "no-store")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			current, err := j.revokeDevice(w, r, r.PostFormValue("revoke"))
+			switch {
+			case errors.Is(err, ErrSessionNotFound):
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			case err != nil:
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case html:
+				// Redirect so that reloading the page doesn't repost the form.
+				http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+				return
+			case current:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		list, err := j.listDevices(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if html {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			devicesPage.Execute(w, list)
+			return
+		}
+		writeJSON(w, list)
+	})))
+}
+
+// revokeDevice revokes the session of the active session's key with the given
+// ID, or all but the active session, and reports whether the active session
+// was revoked.
+func (j *Jeff) revokeDevice(w http.ResponseWriter, r *http.Request, id string) (bool, error) {
+	ctx := r.Context()
+	active := ActiveSession(ctx)
+	if id == "others" {
+		return false, j.revokeOthers(ctx, active.Key, active.Token)
+	}
+	if id == active.ID() {
+		return true, j.Clear(ctx, w)
+	}
+	return false, j.revokeID(ctx, active.Key, id)
+}
+
+func (j *Jeff) listDevices(r *http.Request) (deviceList, error) {
+	active := ActiveSession(r.Context())
+	sl, err := j.load(r.Context(), active.Key)
+	if err != nil {
+		return deviceList{}, err
+	}
+	list := deviceList{Sessions: []device{}, CSRFToken: CSRFToken(r.Context())}
+	for _, s := range prune(sl) {
+		d := describe(s)
+		d.Current = s.ID() == active.ID()
+		list.Sessions = append(list.Sessions, d)
+	}
+	sort.SliceStable(list.Sessions, func(a, b int) bool {
+		return list.Sessions[a].Current && !list.Sessions[b].Current
+	})
+	return list, nil
+}
+
+func describe(s Session) device {
+	return device{
+		ID:        s.ID(),
+		Device:    s.Device,
+		UserAgent: s.UserAgent,
+		IP:        s.IP,
+		Created:   optionalTime(s.Created),
+		LastSeen:  optionalTime(s.LastSeen),
+		Expires:   s.Exp,
+	}
+}
+
+// optionalTime returns nil for the zero time, which sessions stored by older
+// versions have in place of the fields they didn't record.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+var devicesPage = template.Must(template.New("devices").Funcs(template.FuncMap{
+	"date": func(t *time.Time) string {
+		if t == nil {
+			return "unknown"
+		}
+		return t.Format("2 Jan 2006 15:04 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Your devices</title>
+</head>
+<body>
+<h1>Your devices</h1>
+<table>
+<tr><th>Device</th><th>IP address</th><th>Signed in</th><th>Last active</th><th></th></tr>
+{{- range .Sessions}}
+<tr>
+<td>{{if .Device}}{{.Device}}{{else if .UserAgent}}{{.UserAgent}}{{else}}Unknown device{{end}}</td>
+<td>{{.IP}}</td>
+<td>{{date .Created}}</td>
+<td>{{date .LastSeen}}</td>
+<td>{{if .Current}}This device{{else}}<form method="post"><input type="hidden" name="csrf_token" value="{{$.CSRFToken}}"><button name="revoke" value="{{.ID}}">Sign out</button></form>{{end}}</td>
+</tr>
+{{- end}}
+</table>
+<form method="post"><input type="hidden" name="csrf_token" value="{{.CSRFToken}}"><button name="revoke" value="others">Sign out all other sessions</button></form>
+</body>
+</html>
+`))
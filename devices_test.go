@@ -0,0 +1,117 @@
+package jeff_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deviceList struct {
+	Sessions []struct {
+		ID        string `json:"id"`
+		Current   bool   `json:"current"`
+		UserAgent string `json:"user_agent"`
+	} `json:"sessions"`
+	CSRFToken string `json:"csrf_token"`
+}
+
+func devicesServer(t *testing.T) (http.Handler, func(ua string) *http.Cookie) {
+	j := jeff.New(memory.New(), jeff.Redirect(redir))
+	r := http.NewServeMux()
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, j.Set(j.WithClient(r), w, email))
+	})
+	r.Handle("/devices", j.DevicesHTML())
+	login := func(ua string) *http.Cookie {
+		req := httptest.NewRequest("GET", "http://example.com/login", nil)
+		req.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, 1, len(w.Result().Cookies()), "login should set cookie")
+		return w.Result().Cookies()[0]
+	}
+	return r, login
+}
+
+func devices(t *testing.T, resp *http.Response) deviceList {
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var list deviceList
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	return list
+}
+
+func TestDevices(t *testing.T) {
+	h, login := devicesServer(t)
+	laptop, phone, tablet := login("laptop"), login("phone"), login("tablet")
+
+	list := devices(t, get(h, "/devices", laptop))
+	require.Equal(t, 3, len(list.Sessions))
+	assert.True(t, list.Sessions[0].Current, "current session should be listed first")
+	assert.Equal(t, "laptop", list.Sessions[0].UserAgent)
+	assert.False(t, list.Sessions[1].Current)
+	assert.False(t, list.Sessions[2].Current)
+	var phoneID string
+	for _, s := range list.Sessions {
+		if s.UserAgent == "phone" {
+			phoneID = s.ID
+		}
+	}
+	require.NotEmpty(t, phoneID)
+
+	resp := post(h, "/devices", url.Values{"revoke": {phoneID}}, "", laptop)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "revoking without a CSRF token should fail")
+
+	list = devices(t, post(h, "/devices", url.Values{"revoke": {phoneID}}, list.CSRFToken, laptop))
+	assert.Equal(t, 2, len(list.Sessions), "revoked session shouldn't be listed")
+	assert.Equal(t, http.StatusFound, get(h, "/devices", phone).StatusCode, "revoked session should be invalid")
+
+	resp = post(h, "/devices", url.Values{"revoke": {phoneID}}, list.CSRFToken, laptop)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown sessions can't be revoked")
+
+	list = devices(t, post(h, "/devices", url.Values{"revoke": {"others"}}, list.CSRFToken, laptop))
+	require.Equal(t, 1, len(list.Sessions), "only the current session should remain")
+	assert.True(t, list.Sessions[0].Current)
+	assert.Equal(t, http.StatusFound, get(h, "/devices", tablet).StatusCode, "other sessions should be invalid")
+
+	resp = post(h, "/devices", url.Values{"revoke": {list.Sessions[0].ID}}, list.CSRFToken, laptop)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, http.StatusFound, get(h, "/devices", laptop).StatusCode, "revoking the current session should log out")
+}
+
+func TestDevicesHTML(t *testing.T) {
+	h, login := devicesServer(t)
+	laptop := login("laptop")
+	login("<script>")
+
+	req := httptest.NewRequest("GET", "http://example.com/devices", nil)
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(laptop)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	page := body(t, resp)
+	assert.Contains(t, page, "This device")
+	assert.Contains(t, page, `name="csrf_token"`)
+	assert.Contains(t, page, "&lt;script&gt;", "user agents should be escaped")
+
+	list := devices(t, get(h, "/devices", laptop))
+	form := url.Values{"revoke": {"others"}, "csrf_token": {list.CSRFToken}}
+	req = httptest.NewRequest("POST", "http://example.com/devices", nil)
+	req.PostForm = form
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(laptop)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "browsers should be redirected back to the list")
+	assert.Equal(t, "/devices", w.Header().Get("Location"))
+}
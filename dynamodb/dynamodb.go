@@ -0,0 +1,206 @@
+package dynamodb_store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+var now = func() time.Time {
+	return time.Now()
+}
+
+// Attribute names of the items sessions are stored in.
+const (
+	keyAttr     = "session_key"
+	dataAttr    = "data"
+	expAttr     = "exp"
+	versionAttr = "version"
+)
+
+// Store satisfies the jeff.Storage interface.  Each item holds the value of
+// one storage key, such as the list of sessions for a session key, the time
+// it expires at in seconds since the epoch, and a version which is bumped on
+// every write.
+//
+// The expiration attribute, exp, is meant to be the table's TTL attribute, so
+// DynamoDB deletes expired items.  As it may take days to do so, Fetch ignores
+// items which have expired.
+type Store struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// New initializes a new DynamoDB Storage for jeff, storing sessions in the
+// given table.  The table must have a binary partition key named session_key;
+// CreateTable creates one.
+func New(db dynamodbiface.DynamoDBAPI, table string) *Store {
+	return &Store{db: db, table: table}
+}
+
+// CreateTable creates the table sessions are stored in, billed per request,
+// and enables TTL on it.  It waits for the table to become active.
+func (s *Store) CreateTable(ctx context.Context) error {
+	_, err := s.db.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(s.table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{
+			AttributeName: aws.String(keyAttr),
+			AttributeType: aws.String(dynamodb.ScalarAttributeTypeB),
+		}},
+		KeySchema: []*dynamodb.KeySchemaElement{{
+			AttributeName: aws.String(keyAttr),
+			KeyType:       aws.String(dynamodb.KeyTypeHash),
+		}},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	if err != nil {
+		return err
+	}
+	err = s.db.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(s.table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(expAttr),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
+}
+
+// Store satisfies the jeff.Store.Store method
+func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	_, err := s.db.UpdateItemWithContext(ctx, s.write(key, value, exp))
+	return err
+}
+
+// Fetch satisfies the jeff.Store.Fetch method
+func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	item, err := s.get(ctx, key)
+	if err != nil || !live(item) {
+		return nil, err
+	}
+	return item[dataAttr].B, nil
+}
+
+// Delete satisfies the jeff.Store.Delete method
+func (s *Store) Delete(ctx context.Context, key []byte) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.key(key),
+	})
+	return err
+}
+
+// Update satisfies the jeff.Updater method.  Writes are conditional on the
+// version being the one read, retrying otherwise, so concurrent updates
+// aren't lost.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item, err := s.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		var cur []byte
+		if live(item) {
+			cur = item[dataAttr].B
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case item == nil && value == nil:
+			return nil
+		case value == nil:
+			_, err = s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+				TableName:                 aws.String(s.table),
+				Key:                       s.key(key),
+				ConditionExpression:       aws.String("#v = :version"),
+				ExpressionAttributeNames:  map[string]*string{"#v": aws.String(versionAttr)},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":version": item[versionAttr]},
+			})
+		case item == nil:
+			// Another writer may have created the item in the meantime.
+			in := s.write(key, value, exp)
+			in.ConditionExpression = aws.String("attribute_not_exists(#k)")
+			in.ExpressionAttributeNames["#k"] = aws.String(keyAttr)
+			_, err = s.db.UpdateItemWithContext(ctx, in)
+		default:
+			in := s.write(key, value, exp)
+			in.ConditionExpression = aws.String("#v = :version")
+			in.ExpressionAttributeValues[":version"] = item[versionAttr]
+			_, err = s.db.UpdateItemWithContext(ctx, in)
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		return err
+	}
+}
+
+func (s *Store) key(key []byte) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{keyAttr: {B: key}}
+}
+
+// get returns the item for key, which is nil if there is none.  Reads are
+// strongly consistent, so a session is found right after it's stored.
+func (s *Store) get(ctx context.Context, key []byte) (map[string]*dynamodb.AttributeValue, error) {
+	out, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// write returns the request writing value to key and bumping its version.
+func (s *Store) write(key, value []byte, exp time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              s.key(key),
+		UpdateExpression: aws.String("SET #d = :data, #e = :exp ADD #v :one"),
+		// Some attribute names are reserved words.
+		ExpressionAttributeNames: map[string]*string{
+			"#d": aws.String(dataAttr),
+			"#e": aws.String(expAttr),
+			"#v": aws.String(versionAttr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":data": {B: value},
+			":exp":  {N: aws.String(ttl(exp))},
+			":one":  {N: aws.String("1")},
+		},
+	}
+}
+
+// ttl returns exp in seconds since the epoch, rounded up so items don't
+// expire early.
+func ttl(exp time.Time) string {
+	return strconv.FormatInt((exp.UnixNano()+int64(time.Second)-1)/int64(time.Second), 10)
+}
+
+// live reports whether item exists and hasn't expired.
+func live(item map[string]*dynamodb.AttributeValue) bool {
+	if item == nil || item[expAttr] == nil || item[expAttr].N == nil {
+		return false
+	}
+	exp, err := strconv.ParseInt(*item[expAttr].N, 10, 64)
+	return err == nil && exp > now().Unix()
+}
@@ -0,0 +1,35 @@
+package dynamodb_store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff/internal/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiredItems(t *testing.T) {
+	ctx := context.Background()
+	str := storetest.DynamoDB(t)
+	// DynamoDB deletes expired items lazily, so they're still in the table.
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Minute)))
+
+	v, err := str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, v, "expired items shouldn't be fetched")
+
+	err = str.Update(ctx, []byte("old"), func(v []byte) ([]byte, time.Time, error) {
+		assert.Nil(t, v, "expired items shouldn't be updated")
+		return []byte("new"), time.Now().Add(time.Minute), nil
+	})
+	require.NoError(t, err)
+	v, err = str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+}
+
+func TestUpdateConflict(t *testing.T) {
+	storetest.ConcurrentUpdates(t, storetest.DynamoDB(t))
+}
@@ -0,0 +1,120 @@
+package jeff
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// epochPrefix namespaces the "not valid before" times of keys in the Storage.
+// The global one is stored under the prefix alone.
+const epochPrefix = reservedPrefix + "nbf"
+
+// epochKey returns the key of the time for key, or of the global one if key is
+// nil.  Keys are hashed so that the record's key has a fixed length.
+func epochKey(key []byte) []byte {
+	if key == nil {
+		return []byte(epochPrefix)
+	}
+	sum := sha256.Sum256(key)
+	return []byte(epochPrefix + ":" + hex.EncodeToString(sum[:]))
+}
+
+// Epochs enables InvalidateBefore and InvalidateAllBefore, which keep a time
+// in the Storage before which sessions are invalid.  Checking those times
+// costs every authenticated request two more reads from the Storage, so it's
+// off by default.
+func Epochs(j *Jeff) {
+	j.epochs = true
+}
+
+// InvalidateBefore invalidates every session for key created before the given
+// time, such as the start of an incident.  It requires the Epochs option,
+// returning ErrNoEpochs otherwise.  It can't race with a concurrent Set: the
+// time is kept in the Storage, and sessions created before it are rejected
+// with ErrSessionInvalidated even if a stale copy of the list is written back.
+// Times in the future are treated as now.
+func (j *Jeff) InvalidateBefore(ctx context.Context, key []byte, t time.Time) error {
+	if !j.epochs {
+		return ErrNoEpochs
+	}
+	if t.After(now()) {
+		t = now()
+	}
+	sl, err := j.load(ctx, key)
+	if err != nil {
+		return err
+	}
+	// The time only needs to be kept while the sessions it invalidates could
+	// still be valid, including any being created concurrently.
+	exp := j.expiration(time.Time{})
+	for _, s := range sl {
+		if s.Created.Before(t) && s.Exp.After(exp) {
+			exp = s.Exp
+		}
+	}
+	if err := j.setEpoch(ctx, key, t, exp); err != nil {
+		return err
+	}
+	return j.update(ctx, key, func(sl SessionList) SessionList {
+		kept := sl[:0]
+		for _, s := range sl {
+			if !s.Created.Before(t) {
+				kept = append(kept, s)
+			}
+		}
+		return kept
+	})
+}
+
+// InvalidateAllBefore invalidates every session for every key created before
+// the given time, without enumerating them.  It requires the Epochs option,
+// returning ErrNoEpochs otherwise.  The time is kept for as long as a session
+// issued under this Jeff's configuration can live, so sessions given longer
+// lifetimes by Extend, or by differently configured instances, may outlive
+// it.  Times in the future are treated as now.
+func (j *Jeff) InvalidateAllBefore(ctx context.Context, t time.Time) error {
+	if !j.epochs {
+		return ErrNoEpochs
+	}
+	if t.After(now()) {
+		t = now()
+	}
+	return j.setEpoch(ctx, nil, t, j.expiration(time.Time{}))
+}
+
+func (j *Jeff) setEpoch(ctx context.Context, key []byte, t, exp time.Time) error {
+	v, err := t.UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	return storageErr(j.s.Store(ctx, j.recordKey(epochKey(key)), v, exp))
+}
+
+// epoch returns the time before which sessions for key are invalid, or the
+// zero time if there is none.  A nil key returns the global one.
+func (j *Jeff) epoch(ctx context.Context, key []byte) (time.Time, error) {
+	var t time.Time
+	v, err := j.s.Fetch(ctx, j.recordKey(epochKey(key)))
+	if err != nil || v == nil {
+		return t, storageErr(err)
+	}
+	return t, storageErr(t.UnmarshalText(v))
+}
+
+// checkEpochs returns ErrSessionInvalidated if s was created before the time
+// set for its key or for all keys.  Sessions stored by older versions have no
+// creation time, so they're invalidated by any epoch.
+func (j *Jeff) checkEpochs(ctx context.Context, s Session) error {
+	for _, key := range [][]byte{s.Key, nil} {
+		t, err := j.epoch(ctx, key)
+		if err != nil {
+			return err
+		}
+		if s.Created.Before(t) {
+			return ErrSessionInvalidated
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package jeff
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Errors describing why a request couldn't be authenticated or was rejected.
+// The redirect handler can retrieve them with FailureReason.
+var (
+	// ErrNoCookie means the request carried no session cookie, nor any other
+	// credential configured with Bearer or Extract, or only a cookie cleared
+	// with Clear.
+	ErrNoCookie = errors.New("jeff: no session cookie")
+	// ErrMalformedCookie means the session cookie isn't in a format Jeff
+	// issues, which may indicate tampering.
+	ErrMalformedCookie = errors.New("jeff: malformed session cookie")
+	// ErrInvalidEncoding means the session key in the cookie isn't valid
+	// base64, which may indicate tampering.
+	ErrInvalidEncoding = errors.New("jeff: invalid session key encoding")
+	// ErrSessionNotFound means the session doesn't exist in the backend,
+	// usually because it was cleared or deleted.
+	ErrSessionNotFound = errors.New("jeff: session not found")
+	// ErrSessionExpired means the session exists but has expired.
+	ErrSessionExpired = errors.New("jeff: session expired")
+	// ErrTokenReused means a token was presented after the session was
+	// rotated away from it, which indicates it was stolen.  The session has
+	// been revoked.
+	ErrTokenReused = errors.New("jeff: rotated session token reused")
+	// ErrSessionInvalidated means the session was created before a time
+	// set with InvalidateBefore or InvalidateAllBefore.
+	ErrSessionInvalidated = errors.New("jeff: session invalidated")
+	// ErrCSRF means an unsafe request didn't carry a valid CSRF token.
+	ErrCSRF = errors.New("jeff: invalid CSRF token")
+	// ErrCrossSite means an unsafe request was made by a browser on behalf of
+	// another site.
+	ErrCrossSite = errors.New("jeff: cross-site request rejected")
+	// ErrNoActiveSession means there's no session on the context.
+	ErrNoActiveSession = errors.New("jeff: no active session")
+	// ErrNoEpochs means InvalidateBefore or InvalidateAllBefore was called
+	// without the Epochs option, which they need.
+	ErrNoEpochs = errors.New("jeff: Epochs option not set")
+	// ErrInvalidKey means the Storage can't hold a key, such as a memcache
+	// key with spaces in it.  Storages return it, possibly wrapped, for keys
+	// they reject without asking the backend, and Jeff doesn't mark it as
+	// ErrStorage.  Keys taken from a request are reported as
+	// ErrMalformedCookie instead.
+	ErrInvalidKey = errors.New("jeff: key not valid for the storage")
+	// ErrStorage means the Storage returned an error or data that couldn't be
+	// decoded.  The original error can be retrieved with errors.Unwrap.
+	ErrStorage = errors.New("jeff: storage error")
+)
+
+var failureKey = contextKey{name: "failure"}
+
+// FailureReason returns the reason authentication failed for the request
+// whose context is given.  It's set for the redirect handler, and for handlers
+// wrapped with Public when the request isn't authenticated.  It returns nil if
+// authentication didn't fail.
+//
+//	sessions := jeff.New(store, jeff.Redirect(
+//	    http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        if errors.Is(jeff.FailureReason(r.Context()), jeff.ErrStorage) {
+//	            http.Error(w, "try again later", http.StatusServiceUnavailable)
+//	            return
+//	        }
+//	        http.Redirect(w, r, "/login", http.StatusFound)
+//	    })))
+func FailureReason(ctx context.Context) error {
+	if err, ok := ctx.Value(failureKey).(error); ok {
+		return err
+	}
+	return nil
+}
+
+// fail calls h for the request, with err as the FailureReason.
+func fail(h http.Handler, w http.ResponseWriter, r *http.Request, err error) {
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), failureKey, err)))
+}
+
+// storageError marks an error as coming from the Storage.
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return ErrStorage.Error() + ": " + e.err.Error()
+}
+
+func (e storageError) Unwrap() error {
+	return e.err
+}
+
+func (e storageError) Is(target error) bool {
+	return target == ErrStorage
+}
+
+// storageErr wraps a non-nil error returned by the Storage.  Invalid keys are
+// the caller's fault rather than the Storage's, so they're left as they are.
+func storageErr(err error) error {
+	if err == nil || errors.Is(err, ErrInvalidKey) {
+		return err
+	}
+	return storageError{err: err}
+}
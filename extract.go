@@ -0,0 +1,67 @@
+package jeff
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Extractor finds the session credential, in the same format as the cookie
+// value, in a request.  It returns the empty string if the request doesn't
+// carry one.
+type Extractor func(r *http.Request) string
+
+// FromCookie returns an Extractor reading the credential from the named
+// cookie.
+func FromCookie(name string) Extractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// FromBearer is an Extractor reading the credential from an Authorization
+// header using the Bearer scheme.
+func FromBearer(r *http.Request) string {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// Bearer accepts credentials in an Authorization header using the Bearer
+// scheme, in addition to the session cookie.  Use Issue to hand out
+// credentials to clients which can't keep cookies.
+func Bearer(j *Jeff) {
+	j.bearer = true
+}
+
+// Extract sets the Extractors tried in order to find the session credential
+// in a request, replacing the session cookie and Bearer.  To keep accepting
+// the session cookie, include FromCookie with its name.
+//
+//	sessions := jeff.New(store, jeff.Extract(
+//	    jeff.FromCookie("_gosession"),
+//	    jeff.FromBearer,
+//	))
+func Extract(e ...Extractor) func(*Jeff) {
+	return func(j *Jeff) {
+		j.extractors = e
+	}
+}
+
+// extract returns the first credential found in the request, and whether it
+// came from the session cookie.
+func (j *Jeff) extract(r *http.Request) (string, bool) {
+	for _, e := range j.extractors {
+		if v := e(r); v != "" {
+			c, err := r.Cookie(j.cookieName)
+			return v, err == nil && c.Value == v
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,81 @@
+package jeff_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bearer(h http.Handler, auth string) *http.Response {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Authorization", auth)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestBearer(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	for _, opaque := range []bool{false, true} {
+		opts := []func(*jeff.Jeff){jeff.Redirect(redir), jeff.Bearer, jeff.IdleTimeout(time.Hour)}
+		if opaque {
+			opts = append(opts, jeff.Opaque)
+		}
+		j := jeff.New(memory.New(), opts...)
+		s := &server{j: j, t: t}
+		h := j.Wrap(http.HandlerFunc(s.authed))
+
+		cred, err := j.Issue(context.Background(), email)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, bearer(h, "Bearer "+cred).StatusCode, "bearer credential should be valid")
+		assert.Equal(t, http.StatusOK, bearer(h, "bearer "+cred).StatusCode, "scheme should be case insensitive")
+		assert.Equal(t, http.StatusFound, bearer(h, "Basic "+cred).StatusCode, "other schemes should be ignored")
+
+		jeff.SetTime(func() time.Time { return rec.Add(45 * time.Minute) })
+		resp := bearer(h, "Bearer "+cred)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "bearer credential should be valid")
+		assert.Empty(t, resp.Cookies(), "renewing a bearer credential shouldn't set a cookie")
+
+		jeff.SetTime(func() time.Time { return rec.Add(90 * time.Minute) })
+		resp = bearer(h, "Bearer "+cred)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "renewed bearer credential should be valid")
+		jeff.SetTime(func() time.Time { return rec })
+	}
+
+	t.Run("challenge", func(t *testing.T) {
+		j := jeff.New(memory.New(), jeff.Bearer, jeff.API)
+		resp := bearer(j.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})), "")
+		assert.Contains(t, resp.Header.Values("WWW-Authenticate"), "Bearer")
+	})
+}
+
+func TestExtract(t *testing.T) {
+	jeff.SetTime(func() time.Time { return time.Now() })
+	fromQuery := func(r *http.Request) string { return r.URL.Query().Get("session") }
+	j := jeff.New(memory.New(), jeff.Redirect(redir), jeff.Extract(fromQuery))
+	s := &server{j: j, t: t}
+	h := j.Wrap(http.HandlerFunc(s.authed))
+
+	w := httptest.NewRecorder()
+	require.NoError(t, j.Set(context.Background(), w, email))
+	cookie := w.Result().Cookies()[0]
+
+	req := httptest.NewRequest("GET", "http://example.com/?session="+cookie.Value, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode, "custom extractor should be used")
+
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Result().StatusCode, "replaced extractors shouldn't be used")
+}
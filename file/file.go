@@ -0,0 +1,277 @@
+package file_store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var now = func() time.Time {
+	return time.Now()
+}
+
+const (
+	lockName   = ".lock"
+	tempPrefix = ".tmp-"
+)
+
+// Store satisfies the jeff.Storage interface.  Each value is kept in a file
+// in the directory, named after the SHA-256 digest of its key and prefixed
+// with its expiration, as nanoseconds since the epoch in 8 big-endian bytes.
+//
+// Files are written to a temporary file, synced and renamed into place, so
+// readers never see a partial write, even after a crash.  Writes hold a lock
+// on the directory, so several processes can share it.  On platforms without
+// file locks, such as Plan 9 and WebAssembly, writes are only serialized
+// within the process.
+type Store struct {
+	dir   string
+	every time.Duration
+
+	// mu serializes the use of lock within the process; lock is the file
+	// locked against other processes.
+	mu   sync.Mutex
+	lock *os.File
+
+	close sync.Once
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// New returns a Storage for jeff keeping sessions in dir, creating it if
+// needed.  Close releases its resources.
+func New(dir string, opts ...func(*Store)) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:   dir,
+		every: 10 * time.Minute,
+		lock:  lock,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	go s.sweeper()
+	return s, nil
+}
+
+// SweepEvery sets how often expired sessions, and temporary files left behind
+// by crashes, are deleted in the background.  It defaults to 10 minutes, and 0
+// disables it.
+func SweepEvery(d time.Duration) func(*Store) {
+	return func(s *Store) {
+		s.every = d
+	}
+}
+
+// Close stops the background sweeper and releases the lock file.
+func (s *Store) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.lock.Close()
+	})
+	return err
+}
+
+func (s *Store) sweeper() {
+	defer close(s.done)
+	if s.every == 0 {
+		return
+	}
+	t := time.NewTicker(s.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			// A failed sweep is retried on the next tick.
+			s.Sweep()
+		}
+	}
+}
+
+// Sweep deletes the expired sessions, returning how many there were, and any
+// temporary files left behind by crashes.
+func (s *Store) Sweep() (int, error) {
+	var n int
+	err := s.locked(func() error {
+		names, err := readDirNames(s.dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			path := filepath.Join(s.dir, name)
+			if strings.HasPrefix(name, tempPrefix) {
+				// Temporary files are only written with the lock held.
+				os.Remove(path)
+				continue
+			}
+			if name == lockName {
+				continue
+			}
+			if _, ok, err := read(path); err != nil || ok {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Store satisfies the jeff.Store.Store method
+func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.locked(func() error {
+		return s.write(s.path(key), value, exp)
+	})
+}
+
+// Fetch satisfies the jeff.Store.Fetch method
+func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Files are replaced by renames, so they can be read without the lock.
+	v, _, err := read(s.path(key))
+	return v, err
+}
+
+// Delete satisfies the jeff.Store.Delete method
+func (s *Store) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.locked(func() error {
+		return remove(s.path(key))
+	})
+}
+
+// Update satisfies the jeff.Updater method.  fn is called while holding the
+// lock on the directory, so updates are serialized across processes.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := s.path(key)
+	return s.locked(func() error {
+		cur, _, err := read(path)
+		if err != nil {
+			return err
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return remove(path)
+		}
+		return s.write(path, value, exp)
+	})
+}
+
+// path returns the path of the file for key.  Keys are hashed, as they may
+// contain anything, including path separators.
+func (s *Store) path(key []byte) string {
+	sum := sha256.Sum256(key)
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// locked calls fn holding the lock on the directory.
+func (s *Store) locked(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := lock(s.lock); err != nil {
+		return err
+	}
+	defer unlock(s.lock)
+	return fn()
+}
+
+// write atomically replaces the file at path, syncing it to disk.
+func (s *Store) write(path string, value []byte, exp time.Time) error {
+	f, err := ioutil.TempFile(s.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(exp.UnixNano()))
+	if _, err := f.Write(b[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// read returns the value in the file at path, and false if it's missing or
+// has expired.
+func read(path string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(b) < 8 {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	if int64(binary.BigEndian.Uint64(b)) <= now().UnixNano() {
+		return nil, false, nil
+	}
+	return b[8:], true, nil
+}
+
+func remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
@@ -0,0 +1,54 @@
+package file_store_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	file_store "github.com/abraithwaite/jeff/file"
+	"github.com/abraithwaite/jeff/internal/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "jeff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	str, err := file_store.New(dir, file_store.SweepEvery(0))
+	require.NoError(t, err)
+	defer str.Close()
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Second)))
+	require.NoError(t, str.Store(ctx, []byte("new/../key"), []byte("value"), time.Now().Add(time.Hour)))
+	// Left behind by a crash mid-write.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("partial"), 0600))
+
+	v, err := str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, v, "expired sessions shouldn't be fetched")
+
+	n, err := str.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Len(t, names, 2, "only the lock file and the unexpired session should be left")
+
+	// Sessions survive reopening the directory.
+	str, err = file_store.New(dir, file_store.SweepEvery(0))
+	require.NoError(t, err)
+	defer str.Close()
+	v, err = str.Fetch(ctx, []byte("new/../key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), v)
+}
+
+func TestSharedDirectory(t *testing.T) {
+	dir := storetest.TempDir(t)
+	storetest.ConcurrentUpdates(t, storetest.File(t, dir), storetest.File(t, dir))
+}
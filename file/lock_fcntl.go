@@ -0,0 +1,42 @@
+//go:build aix || solaris
+// +build aix solaris
+
+package file_store
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// fcntlMu serializes the lock within the process.  These platforms have no
+// flock, and fcntl locks belong to the process rather than the file
+// descriptor, so they don't keep out other Stores on the same directory in
+// this process.  Closing any of those Stores also releases the lock, so they
+// should be closed once no others are in use.
+var fcntlMu sync.Mutex
+
+func lock(f *os.File) error {
+	fcntlMu.Lock()
+	err := fcntl(f, syscall.F_WRLCK)
+	if err != nil {
+		fcntlMu.Unlock()
+	}
+	return err
+}
+
+func unlock(f *os.File) error {
+	defer fcntlMu.Unlock()
+	return fcntl(f, syscall.F_UNLCK)
+}
+
+func fcntl(f *os.File, typ int16) error {
+	lk := syscall.Flock_t{Type: typ, Whence: io.SeekStart}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lk)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package file_store
+
+import (
+	"os"
+	"sync"
+)
+
+// otherMu stands in for a file lock on platforms without one, such as Plan 9
+// and WebAssembly.  It only serializes Stores within the process, so a
+// directory mustn't be shared between processes there.
+var otherMu sync.Mutex
+
+func lock(*os.File) error {
+	otherMu.Lock()
+	return nil
+}
+
+func unlock(*os.File) error {
+	otherMu.Unlock()
+	return nil
+}
+
+// syncDir does nothing, as these platforms can't sync directories.
+func syncDir(string) error {
+	return nil
+}
@@ -3,10 +3,14 @@ module github.com/abraithwaite/jeff
 go 1.14
 
 require (
+	github.com/aws/aws-sdk-go v1.38.0
 	github.com/bradfitz/gomemcache v0.0.0-20180710155616-bc664df96737
 	github.com/gomodule/redigo v1.8.5
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.7.0
-	github.com/stretchr/testify v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/stretchr/testify v1.6.1
 	github.com/tinylib/msgp v1.1.6
+	go.etcd.io/bbolt v1.3.6
+	go.mongodb.org/mongo-driver v1.5.1
 )
@@ -0,0 +1,145 @@
+// Package storetest holds the fixtures shared by the tests of jeff and its
+// stores.  Each returns a Store in a fresh table, collection or directory,
+// which is removed when the test completes.
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	bolt_store "github.com/abraithwaite/jeff/bolt"
+	dynamodb_store "github.com/abraithwaite/jeff/dynamodb"
+	file_store "github.com/abraithwaite/jeff/file"
+	mongo_store "github.com/abraithwaite/jeff/mongo"
+	sql_store "github.com/abraithwaite/jeff/sql"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TempDir returns a new temporary directory.
+func TempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "jeff")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// Bolt returns a Store in a new bbolt database.
+func Bolt(t *testing.T) *bolt_store.Store {
+	str, err := bolt_store.Open(filepath.Join(TempDir(t), "sessions.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { str.Close() })
+	return str
+}
+
+// File returns a Store in dir.  Each Store locks the directory through its
+// own file, as separate processes would.
+func File(t *testing.T, dir string) *file_store.Store {
+	str, err := file_store.New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { str.Close() })
+	return str
+}
+
+// SQLiteDB returns a new SQLite database.
+func SQLiteDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(TempDir(t), "sessions.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// SQLite returns a migrated Store in a new SQLite database.  The pool is
+// limited to one connection, so writers wait for each other instead of
+// failing with "database is locked".
+func SQLite(t *testing.T) *sql_store.Store {
+	db := SQLiteDB(t)
+	db.SetMaxOpenConns(1)
+	str := sql_store.New(db, sql_store.SQLite)
+	require.NoError(t, str.Migrate(context.Background()))
+	return str
+}
+
+// DynamoDB returns a Store in a new table in DynamoDB Local.
+func DynamoDB(t *testing.T) *dynamodb_store.Store {
+	db := dynamodb.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String("http://localhost:8000"),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("jeff", "jeff", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+	table := fmt.Sprintf("jeff_%d", time.Now().UnixNano())
+	str := dynamodb_store.New(db, table)
+	require.NoError(t, str.CreateTable(context.Background()))
+	t.Cleanup(func() { db.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)}) })
+	return str
+}
+
+// MongoCollection returns a new collection in the local mongod.
+func MongoCollection(t *testing.T) *mongo.Collection {
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().
+		ApplyURI("mongodb://localhost:27017").
+		SetServerSelectionTimeout(2*time.Second))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Disconnect(ctx) })
+	coll := client.Database("jeff_test").Collection(fmt.Sprintf("sessions_%d", time.Now().UnixNano()))
+	t.Cleanup(func() { coll.Drop(ctx) })
+	return coll
+}
+
+// Mongo returns a Store in a new collection in the local mongod.
+func Mongo(t *testing.T) *mongo_store.Store {
+	str := mongo_store.New(MongoCollection(t))
+	require.NoError(t, str.CreateIndex(context.Background()))
+	return str
+}
+
+// Updater is a Storage with atomic updates.
+type Updater interface {
+	jeff.Storage
+	jeff.Updater
+}
+
+// ConcurrentUpdates increments a counter from several goroutines at once,
+// spread across the stores, and checks that no increment is lost.  The
+// stores must share a backend.
+func ConcurrentUpdates(t *testing.T, stores ...Updater) {
+	const n = 20
+	ctx := context.Background()
+	key := []byte("counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 2*len(stores); i++ {
+		wg.Add(1)
+		go func(str Updater) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				err := str.Update(ctx, key, func(v []byte) ([]byte, time.Time, error) {
+					c, _ := strconv.Atoi(string(v))
+					return []byte(strconv.Itoa(c + 1)), time.Now().Add(time.Hour), nil
+				})
+				assert.NoError(t, err)
+			}
+		}(stores[i%len(stores)])
+	}
+	wg.Wait()
+	v, err := stores[0].Fetch(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(2*len(stores)*n), string(v), "no updates should be lost")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/abraithwaite/jeff"
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
@@ -17,6 +18,15 @@ func New(mc *memcache.Client) *Store {
 	return &Store{mc: mc}
 }
 
+// keyErr reports keys memcache rejects, such as ones with spaces or longer
+// than 250 bytes, as jeff.ErrInvalidKey.
+func keyErr(err error) error {
+	if err == memcache.ErrMalformedKey {
+		return jeff.ErrInvalidKey
+	}
+	return err
+}
+
 // Store satisfies the jeff.Store.Store method
 func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
 	e := int32(exp.UTC().Unix())
@@ -36,7 +46,7 @@ func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) err
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-done:
-		return err
+		return keyErr(err)
 	}
 }
 
@@ -60,7 +70,7 @@ func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, keyErr(err)
 	}
 	return i.Value, nil
 }
@@ -77,6 +87,70 @@ func (s *Store) Delete(ctx context.Context, key []byte) error {
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-done:
+		return keyErr(err)
+	}
+}
+
+// Update satisfies the jeff.Updater method.  It uses memcache's
+// compare-and-swap to apply fn atomically, retrying when the key is modified
+// concurrently.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	var err error
+	done := make(chan struct{})
+	go func() {
+		err = s.update(string(key), fn)
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return keyErr(err)
+	}
+}
+
+func (s *Store) update(key string, fn func([]byte) ([]byte, time.Time, error)) error {
+	for {
+		i, err := s.mc.Get(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		var cur []byte
+		if i != nil {
+			cur = i.Value
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			return err
+		}
+
+		if i == nil && value == nil {
+			return nil
+		}
+		if i == nil {
+			// Add fails if another writer created the key in the meantime.
+			err = s.mc.Add(&memcache.Item{
+				Key:        key,
+				Value:      value,
+				Expiration: int32(exp.UTC().Unix()),
+			})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			return err
+		}
+		i.Value = value
+		i.Expiration = int32(exp.UTC().Unix())
+		if value == nil {
+			// memcache has no compare-and-delete, but a negative expiration
+			// makes the swapped item expire immediately.
+			i.Value = []byte{}
+			i.Expiration = -1
+		}
+		err = s.mc.CompareAndSwap(i)
+		if err == memcache.ErrCASConflict || err == memcache.ErrCacheMiss {
+			continue
+		}
 		return err
 	}
 }
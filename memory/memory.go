@@ -57,3 +57,27 @@ func (m *Memory) Delete(_ context.Context, key []byte) error {
 	m.rw.Unlock()
 	return nil
 }
+
+// Update satisfies the jeff.Updater method.  fn is called while holding the
+// write lock, so updates to the same Memory are serialized.
+func (m *Memory) Update(_ context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	var cur []byte
+	if v, ok := m.sessions[string(key)]; ok && !v.exp.Before(time.Now()) {
+		cur = v.value
+	}
+	value, exp, err := fn(cur)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(m.sessions, string(key))
+		return nil
+	}
+	m.sessions[string(key)] = item{
+		value: value,
+		exp:   exp,
+	}
+	return nil
+}
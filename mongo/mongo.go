@@ -0,0 +1,133 @@
+package mongo_store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var now = func() time.Time {
+	return time.Now()
+}
+
+// document is how the value of a storage key, such as the list of sessions
+// for a session key, is stored.  Version is bumped on every write.
+type document struct {
+	Key     []byte    `bson:"_id"`
+	Data    []byte    `bson:"data"`
+	Exp     time.Time `bson:"exp"`
+	Version int64     `bson:"version"`
+}
+
+// Store satisfies the jeff.Storage interface.
+//
+// MongoDB deletes expired documents using the TTL index created by
+// CreateIndex, but only about once a minute, so Fetch ignores documents which
+// have expired.
+type Store struct {
+	coll *mongo.Collection
+}
+
+// New initializes a new MongoDB Storage for jeff, storing sessions in the
+// given collection.
+func New(coll *mongo.Collection) *Store {
+	return &Store{coll: coll}
+}
+
+// CreateIndex creates the TTL index on the collection which deletes expired
+// sessions.  It's safe to call on every start.
+func (s *Store) CreateIndex(ctx context.Context) error {
+	_, err := s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "exp", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Store satisfies the jeff.Store.Store method
+func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	for {
+		_, err := s.coll.UpdateOne(ctx, bson.M{"_id": key}, set(value, exp), options.Update().SetUpsert(true))
+		// Concurrent upserts of the same key can fail with a duplicate key
+		// error, but succeed when retried.
+		if !mongo.IsDuplicateKeyError(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Fetch satisfies the jeff.Store.Fetch method
+func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	var doc document
+	err := s.coll.FindOne(ctx, bson.M{"_id": key, "exp": bson.M{"$gt": now()}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return doc.Data, err
+}
+
+// Delete satisfies the jeff.Store.Delete method
+func (s *Store) Delete(ctx context.Context, key []byte) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// Update satisfies the jeff.Updater method.  Writes only succeed if the
+// document's version is still the one read, retrying otherwise, so
+// concurrent updates aren't lost.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var doc document
+		err := s.coll.FindOne(ctx, bson.M{"_id": key}).Decode(&doc)
+		exists := err == nil
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		var cur []byte
+		if exists && doc.Exp.After(now()) {
+			cur = doc.Data
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			return err
+		}
+
+		current := bson.M{"_id": key, "version": doc.Version}
+		switch {
+		case !exists && value == nil:
+			return nil
+		case !exists:
+			// The insert fails if another writer created the document in
+			// the meantime.
+			_, err = s.coll.InsertOne(ctx, document{Key: key, Data: value, Exp: exp, Version: 1})
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return err
+		case value == nil:
+			res, err := s.coll.DeleteOne(ctx, current)
+			if err != nil || res.DeletedCount > 0 {
+				return err
+			}
+		default:
+			res, err := s.coll.UpdateOne(ctx, current, set(value, exp))
+			if err != nil || res.MatchedCount > 0 {
+				return err
+			}
+		}
+	}
+}
+
+// set returns the update setting a document's value and bumping its version.
+func set(value []byte, exp time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{"data": value, "exp": exp},
+		"$inc": bson.M{"version": int64(1)},
+	}
+}
@@ -0,0 +1,43 @@
+package mongo_store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff/internal/storetest"
+	mongo_store "github.com/abraithwaite/jeff/mongo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExpiredDocuments(t *testing.T) {
+	ctx := context.Background()
+	coll := storetest.MongoCollection(t)
+	str := mongo_store.New(coll)
+	require.NoError(t, str.CreateIndex(ctx))
+	// MongoDB deletes expired documents periodically, so they're still in the
+	// collection.
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Minute)))
+	n, err := coll.CountDocuments(ctx, bson.M{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	v, err := str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, v, "expired documents shouldn't be fetched")
+
+	err = str.Update(ctx, []byte("old"), func(v []byte) ([]byte, time.Time, error) {
+		assert.Nil(t, v, "expired documents shouldn't be updated")
+		return []byte("new"), time.Now().Add(time.Minute), nil
+	})
+	require.NoError(t, err)
+	v, err = str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), v)
+}
+
+func TestUpdateConflict(t *testing.T) {
+	storetest.ConcurrentUpdates(t, storetest.Mongo(t))
+}
@@ -0,0 +1,73 @@
+package jeff_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	var reason error
+	fail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = jeff.FailureReason(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})
+	j := jeff.New(memory.New(), jeff.Redirect(fail),
+		jeff.TrustedOrigins("https://app.example.org/"), jeff.TrustedPaths("/hooks"))
+	h := j.CheckOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		ok      bool
+	}{
+		{"safe method", "GET", "/", map[string]string{"Sec-Fetch-Site": "cross-site"}, true},
+		{"same origin", "POST", "/", map[string]string{"Sec-Fetch-Site": "same-origin"}, true},
+		{"user initiated", "POST", "/", map[string]string{"Sec-Fetch-Site": "none"}, true},
+		{"cross site", "POST", "/", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.com"}, false},
+		{"same site", "POST", "/", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "https://sub.example.com"}, false},
+		{"trusted origin", "POST", "/", map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "https://APP.example.org"}, true},
+		{"trusted path", "POST", "/hooks/github", map[string]string{"Sec-Fetch-Site": "cross-site"}, true},
+		{"untrusted path", "POST", "/hookshot", map[string]string{"Sec-Fetch-Site": "cross-site"}, false},
+		{"origin match", "POST", "/", map[string]string{"Origin": "https://example.com"}, true},
+		{"origin mismatch", "DELETE", "/", map[string]string{"Origin": "https://evil.com"}, false},
+		{"null origin", "POST", "/", map[string]string{"Origin": "null"}, false},
+		{"referer match", "POST", "/", map[string]string{"Referer": "https://example.com/form"}, true},
+		{"referer mismatch", "PUT", "/", map[string]string{"Referer": "https://evil.com/form"}, false},
+		{"no headers", "POST", "/", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason = nil
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if tc.ok {
+				assert.Equal(t, http.StatusOK, w.Code)
+				assert.NoError(t, reason)
+			} else {
+				assert.Equal(t, http.StatusTeapot, w.Code)
+				assert.Equal(t, jeff.ErrCrossSite, reason)
+			}
+		})
+	}
+}
+
+func TestCheckOriginAPI(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.API)
+	h := j.CheckOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("POST", "http://example.com/", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "cross-site request rejected")
+}
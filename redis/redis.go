@@ -29,11 +29,9 @@ func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) err
 	if err != nil {
 		return err
 	}
-	e := int(exp.Sub(now()) / time.Second)
-
 	done := make(chan struct{})
 	go func() {
-		_, err = conn.Do("SETEX", key, strconv.Itoa(e), value)
+		_, err = conn.Do("SETEX", key, ttl(exp), value)
 		close(done)
 	}()
 	select {
@@ -93,3 +91,64 @@ func (s *Store) Delete(ctx context.Context, key []byte) error {
 		return nil
 	}
 }
+
+// Update satisfies the jeff.Updater method.  It uses WATCH and MULTI/EXEC to
+// apply fn atomically, retrying when the key is modified concurrently.
+func (s *Store) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	conn, err := s.pool.GetContext(ctx)
+	defer conn.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		err = update(conn, key, fn)
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return err
+	}
+}
+
+func update(conn redis.Conn, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	for {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		cur, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		value, exp, err := fn(cur)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		if value == nil {
+			conn.Send("DEL", key)
+		} else {
+			conn.Send("SETEX", key, ttl(exp), value)
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		// A nil reply means the watched key changed and the transaction was
+		// aborted.
+		if reply != nil {
+			return nil
+		}
+	}
+}
+
+// ttl converts exp into the number of seconds SETEX expects, rounding up so
+// that a key never expires before the sessions it holds.
+func ttl(exp time.Time) string {
+	return strconv.Itoa(int((exp.Sub(now()) + time.Second - 1) / time.Second))
+}
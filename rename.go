@@ -0,0 +1,87 @@
+package jeff
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// fwdPrefix namespaces the forwarding pointers from renamed keys to their new
+// keys in the Storage.
+const fwdPrefix = reservedPrefix + "fwd:"
+
+// maxForwards bounds how many renames are followed, in case keys were renamed
+// back and forth.
+const maxForwards = 4
+
+// fwdKey returns the key of the forwarding pointer for key.  Keys are hashed
+// so that the record's key has a fixed length.
+func fwdKey(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return []byte(fwdPrefix + hex.EncodeToString(sum[:]))
+}
+
+// RenameKey moves the sessions for oldKey to newKey without logging anyone
+// out, for example when a user changes the email address used as their key.
+// Sessions already stored under newKey are kept.  A forwarding pointer is
+// left at oldKey until the moved sessions would have expired, through which
+// credentials carrying oldKey keep working.  Cookies are re-issued with newKey
+// the next time each device is seen, so only bearer credentials, which can't
+// be re-issued, stop working once the pointer expires.
+func (j *Jeff) RenameKey(ctx context.Context, oldKey, newKey []byte) error {
+	if bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+	sl, err := j.load(ctx, oldKey)
+	if err != nil {
+		return err
+	}
+	sl = prune(sl)
+	if len(sl) == 0 {
+		return nil
+	}
+	moved := make(SessionList, len(sl))
+	tokens := make([][]byte, len(sl))
+	for i, s := range sl {
+		s.Key = newKey
+		moved[i] = s
+		tokens[i] = s.Token
+	}
+	err = j.update(ctx, newKey, func(nl SessionList) SessionList {
+		for _, s := range moved {
+			if _, i := match(nl, s.Token); i < 0 {
+				nl = append(nl, s)
+			}
+		}
+		return nl
+	})
+	if err != nil {
+		return err
+	}
+	// newKey holds sessions again, so it mustn't forward anywhere.
+	if err := j.s.Delete(ctx, j.recordKey(fwdKey(newKey))); err != nil {
+		return storageErr(err)
+	}
+	if err := j.s.Store(ctx, j.recordKey(fwdKey(oldKey)), newKey, latest(sl)); err != nil {
+		return storageErr(err)
+	}
+	// Only the moved sessions are removed, in case one was set concurrently.
+	return j.clear(ctx, oldKey, tokens...)
+}
+
+// forward looks for the session with token tok under the key that key was
+// renamed to, if any.
+func (j *Jeff) forward(ctx context.Context, key, tok []byte, hops int) (Session, error) {
+	if hops == 0 {
+		return Session{}, ErrSessionNotFound
+	}
+	to, err := j.s.Fetch(ctx, j.recordKey(fwdKey(key)))
+	if err != nil {
+		return Session{}, storageErr(err)
+	}
+	if to == nil {
+		return Session{}, ErrSessionNotFound
+	}
+	return j.loadHops(ctx, to, tok, hops-1)
+}
@@ -0,0 +1,121 @@
+package jeff
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// returnParam is the query parameter, or form field, carrying the URL to
+// return to after login.
+const returnParam = "next"
+
+// returnLifetime bounds how long the return cookie is kept for.
+const returnLifetime = 10 * time.Minute
+
+// Login sets the redirect handler to one which sends unauthenticated users to
+// the given login path, remembering the URL they requested so that Return
+// can send them back after logging in.  The URL is passed in the "next" query
+// parameter, or in a short-lived cookie if ReturnCookie is set.  Only GET and
+// HEAD requests are remembered, since other requests can't be replayed by a
+// redirect.
+func Login(login string) func(*Jeff) {
+	return func(j *Jeff) {
+		j.redir = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			j.login(w, r, login)
+		})
+	}
+}
+
+// ReturnCookie makes Login remember the requested URL in a short-lived cookie
+// instead of the "next" query parameter, keeping it out of the login page's
+// URL.
+func ReturnCookie(j *Jeff) {
+	j.retCookie = true
+}
+
+// ReturnPaths restricts the URLs Return redirects to to those whose path is
+// one of the given prefixes, or below it.  By default any path on the same
+// origin is allowed.
+func ReturnPaths(prefixes ...string) func(*Jeff) {
+	return func(j *Jeff) {
+		j.retPaths = prefixes
+	}
+}
+
+func (j *Jeff) login(w http.ResponseWriter, r *http.Request, login string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	next := r.URL.RequestURI()
+	if j.retCookie {
+		// Encoded, since URLs may hold characters cookies can't.
+		c := j.cookie(encode([]byte(next)), time.Time{})
+		c.Name = j.returnCookieName()
+		c.MaxAge = int(returnLifetime / time.Second)
+		http.SetCookie(w, c)
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	u, err := url.Parse(login)
+	if err != nil {
+		http.Redirect(w, r, login, http.StatusFound)
+		return
+	}
+	q := u.Query()
+	q.Set(returnParam, next)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Return redirects the user back to the URL remembered by Login.  Call it
+// after a successful Set.  The URL is taken from the "next" form value, so
+// login forms should pass it along in a hidden field, or from the cookie if
+// ReturnCookie is set.  URLs which aren't a path on the same origin, or aren't
+// allowed by ReturnPaths, are ignored in favor of fallback.
+func (j *Jeff) Return(w http.ResponseWriter, r *http.Request, fallback string) {
+	next := r.FormValue(returnParam)
+	if c, err := r.Cookie(j.returnCookieName()); err == nil {
+		if b, err := decode(c.Value); err == nil && next == "" {
+			next = string(b)
+		}
+		c := j.cookie(clearedValue, time.Time{})
+		c.Name = j.returnCookieName()
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+	if !j.safeReturn(next) {
+		next = fallback
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (j *Jeff) returnCookieName() string {
+	return j.cookieName + "_next"
+}
+
+// safeReturn reports whether target is a path on the same origin allowed by
+// ReturnPaths.
+func (j *Jeff) safeReturn(target string) bool {
+	// Browsers treat backslashes like slashes, so "/\evil.com" is as
+	// dangerous as "//evil.com".  Control characters are stripped by some, so
+	// "/\t/evil.com" is too.
+	if !strings.HasPrefix(target, "/") || strings.ContainsAny(target, "\\") {
+		return false
+	}
+	for _, c := range target {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return false
+	}
+	if strings.HasPrefix(u.Path, "//") {
+		return false
+	}
+	return len(j.retPaths) == 0 || underPath(u.Path, j.retPaths)
+}
@@ -0,0 +1,91 @@
+package jeff_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginNext(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.Login("/login?lang=en"))
+	h := j.WrapFunc(func(http.ResponseWriter, *http.Request) {})
+
+	resp := get(h, "/orders/42?tab=items", nil)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/login", loc.Path)
+	assert.Equal(t, "en", loc.Query().Get("lang"), "login query should be kept")
+	assert.Equal(t, "/orders/42?tab=items", loc.Query().Get("next"), "requested URL should be remembered")
+
+	req := httptest.NewRequest("POST", "http://example.com/orders", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "/login?lang=en", w.Result().Header.Get("Location"), "POST shouldn't be remembered")
+
+	for _, tc := range []struct{ next, want string }{
+		{"/orders/42?tab=items", "/orders/42?tab=items"},
+		{"", "/home"},
+		{"//evil.com", "/home"},
+		{"///evil.com", "/home"},
+		{"/\\evil.com", "/home"},
+		{"/\t/evil.com", "/home"},
+		{"https://evil.com/", "/home"},
+		{"javascript:alert(1)", "/home"},
+		{"evil.com", "/home"},
+		{"/%2F/evil.com", "/home"},
+	} {
+		req := httptest.NewRequest("POST", "http://example.com/login", strings.NewReader(url.Values{"next": {tc.next}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		j.Return(w, req, "/home")
+		resp := w.Result()
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, tc.want, resp.Header.Get("Location"), "next=%q", tc.next)
+	}
+}
+
+func TestReturnCookie(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.Login("/login"), jeff.ReturnCookie)
+	h := j.WrapFunc(func(http.ResponseWriter, *http.Request) {})
+
+	resp := get(h, "/orders/42?tab=items,%20more&q=\"x\"", nil)
+	assert.Equal(t, "/login", resp.Header.Get("Location"), "next shouldn't be in the login URL")
+	require.Equal(t, 1, len(resp.Cookies()), "requested URL should be remembered in a cookie")
+	c := resp.Cookies()[0]
+	assert.True(t, c.MaxAge > 0, "return cookie should be short-lived")
+
+	req := httptest.NewRequest("POST", "http://example.com/login", nil)
+	req.AddCookie(c)
+	w := httptest.NewRecorder()
+	j.Return(w, req, "/home")
+	resp = w.Result()
+	assert.Equal(t, `/orders/42?tab=items,%20more&q="x"`, resp.Header.Get("Location"))
+	require.Equal(t, 1, len(resp.Cookies()), "return cookie should be cleared")
+	assert.True(t, resp.Cookies()[0].MaxAge < 0, "return cookie should be cleared")
+}
+
+func TestReturnPaths(t *testing.T) {
+	j := jeff.New(memory.New(), jeff.ReturnPaths("/app/", "/settings"))
+	for _, tc := range []struct{ next, want string }{
+		{"/app/orders", "/app/orders"},
+		{"/app", "/app"},
+		{"/settings", "/settings"},
+		{"/settings/password", "/settings/password"},
+		{"/settingsx", "/home"},
+		{"/admin", "/home"},
+		{"/app/../admin", "/home"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/login?next="+url.QueryEscape(tc.next), nil)
+		w := httptest.NewRecorder()
+		j.Return(w, req, "/home")
+		assert.Equal(t, tc.want, w.Result().Header.Get("Location"), "next=%q", tc.next)
+	}
+}
@@ -1,20 +1,39 @@
 package jeff
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Cookie Format
 // SessionToken is already encoded and safe
 // CookieName=encode(SessionKey)::SessionToken
+// or, with opaque cookies
+// CookieName=SessionToken
 const separator = "::"
 
+// tokenSize is the number of random bytes in a session token, 192 bits.
+const tokenSize = 24
+
+// clearedValue replaces the value of a cookie when it's cleared, in case the
+// browser keeps it anyway.
+const clearedValue = "deleted"
+
+// rotationHistory is the number of rotated-out tokens kept per session for
+// reuse detection.
+const rotationHistory = 4
+
 var defaultRedirect = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 })
@@ -31,11 +50,29 @@ var now = func() time.Time {
 type Jeff struct {
 	s          Storage
 	redir      http.Handler
+	mode       failureMode
 	cookieName string
 	domain     string
 	path       string
 	expires    time.Duration
+	idle       time.Duration
+	lifetime   time.Duration
+	renew      time.Duration
+	rotateAge  time.Duration
+	grace      time.Duration
+	seenEvery  time.Duration
+	touching   sync.Map
 	insecure   bool
+	opaque     bool
+	epochs     bool
+	mapKey     func([]byte) []byte
+	extractors []Extractor
+	bearer     bool
+	retCookie  bool
+	retPaths   []string
+	origins    []string
+	trusted    []string
+	proxies    []*net.IPNet
 	samesite   http.SameSite
 }
 
@@ -57,7 +94,8 @@ func CookieName(n string) func(*Jeff) {
 
 // Redirect sets the handler which gets called when authentication fails.  By
 // default, this redirects to '/'. It's recommended that you replace this with
-// your own.
+// your own.  The reason authentication failed is available to the handler
+// through FailureReason.
 //
 //     sessions := jeff.New(store, jeff.Redirect(
 //         http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -95,6 +133,68 @@ func Expires(dur time.Duration) func(*Jeff) {
 	}
 }
 
+// IdleTimeout expires sessions which haven't been used for the given
+// duration.  When set, it replaces Expires as the lifetime given to a session
+// on login, and each authenticated request slides the expiration forward and
+// re-issues the cookie to match.  To avoid a write to the backend on every
+// request, the session is only extended once less than the renewal threshold
+// remains, which defaults to half the idle timeout.  See RenewWithin.
+func IdleTimeout(dur time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.idle = dur
+	}
+}
+
+// MaxLifetime sets the absolute lifetime of a session.  However often a
+// session is used or renewed, it expires this long after login.  If unset,
+// sessions may be renewed indefinitely.
+func MaxLifetime(dur time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.lifetime = dur
+	}
+}
+
+// RenewWithin enables sliding renewal of sessions.  When an authenticated
+// request arrives with less than the given duration left before the session
+// expires, the session is extended by the idle timeout, or by Expires if no
+// idle timeout is set, and the cookie is re-issued.  Renewal never extends a
+// session past its MaxLifetime.
+func RenewWithin(dur time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.renew = dur
+	}
+}
+
+// RotateEvery rotates the token of a session once it's older than the given
+// duration.  The check happens on each authenticated request, which is then
+// answered with a cookie carrying the new token.  See Rotate for details.
+func RotateEvery(dur time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.rotateAge = dur
+	}
+}
+
+// RotationGrace sets how long the token a session was just rotated from stays
+// valid, so that requests already in flight from other tabs don't fail.  Past
+// this window, presenting a rotated-out token is treated as theft and the
+// session is revoked.  Defaults to 1 minute.
+func RotationGrace(dur time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.grace = dur
+	}
+}
+
+// TrackLastSeen records when each session was last used in Session.LastSeen,
+// updating it at most once per the given interval to spare the backend a
+// write on every request.  The write happens in the background, so it doesn't
+// hold up the request, and the session on the request's context has LastSeen
+// set to the time of the request.
+func TrackLastSeen(every time.Duration) func(*Jeff) {
+	return func(j *Jeff) {
+		j.seenEvery = every
+	}
+}
+
 // Insecure unsets the Secure flag for the cookie.  This is for development
 // only.  Doing this in production is an error.
 func Insecure(j *Jeff) {
@@ -102,6 +202,38 @@ func Insecure(j *Jeff) {
 	j.insecure = true
 }
 
+// Opaque makes cookies carry only the session token, instead of the session
+// key and token.  Jeff keeps a lookup from each token to its session key in
+// the Storage, so the key (often an email) doesn't show up in browsers or
+// logs.  Cookies in either format are accepted regardless of this option, so
+// it can be turned on without logging anyone out.
+func Opaque(j *Jeff) {
+	j.opaque = true
+}
+
+// MapKey sets the function used to map session keys to the keys they're stored
+// under in the Storage.  By default, session keys are used as is, which leaks
+// them into the backend's keyspace and breaks on keys the backend can't
+// handle, such as memcache keys longer than 250 bytes or containing spaces.
+// The mapping must be deterministic.  Session.Key always holds the original
+// key.
+//
+//     sessions := jeff.New(store, jeff.MapKey(jeff.HashKey("sessions:")))
+func MapKey(f func([]byte) []byte) func(*Jeff) {
+	return func(j *Jeff) {
+		j.mapKey = f
+	}
+}
+
+// HashKey returns a key mapping for MapKey which replaces session keys with
+// the hex encoded SHA-256 digest of the key, prefixed with prefix.
+func HashKey(prefix string) func([]byte) []byte {
+	return func(key []byte) []byte {
+		sum := sha256.Sum256(key)
+		return []byte(prefix + hex.EncodeToString(sum[:]))
+	}
+}
+
 // SameSite sets the SameSite attribute for the cookie.  If unset, the default
 // behavior is to inherit the default behavior of the http package.  See the
 // docs for details.
@@ -117,6 +249,7 @@ func New(s Storage, opts ...func(*Jeff)) *Jeff {
 	j := &Jeff{
 		s:       s,
 		expires: 30 * 24 * time.Hour,
+		grace:   time.Minute,
 	}
 	for _, o := range opts {
 		o(j)
@@ -140,95 +273,268 @@ func (j *Jeff) PublicFunc(wrap http.HandlerFunc) http.HandlerFunc {
 }
 
 // Wrap wraps the given handler, authenticating this route and calling the
-// redirect handler if session is invalid.
+// redirect handler if session is invalid.  See API and Negotiate for other
+// ways to respond.
 func (j *Jeff) Wrap(wrap http.Handler) http.Handler {
-	return j.wrap(j.redir, wrap)
+	return j.wrap(j.failure(), wrap)
 }
 
 // WrapFunc wraps the given handler, authenticating this route and calling the
-// redirect handler if session is invalid.
+// redirect handler if session is invalid.  See API and Negotiate for other
+// ways to respond.
 func (j *Jeff) WrapFunc(wrap http.HandlerFunc) http.HandlerFunc {
-	return j.wrap(j.redir, wrap).ServeHTTP
+	return j.wrap(j.failure(), wrap).ServeHTTP
 }
 
 func (j *Jeff) wrap(redir, wrap http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie(j.cookieName)
-		if err != nil {
-			redir.ServeHTTP(w, r)
+		r = r.WithContext(j.WithClient(r))
+		cred, fromCookie := j.extract(r)
+		if cred == "" {
+			fail(redir, w, r, ErrNoCookie)
 			return
 		}
-		vals := strings.SplitN(c.Value, separator, 2)
-		if len(vals) != 2 {
-			redir.ServeHTTP(w, r)
+		ctx := r.Context()
+		key, tok, err := j.Parse(ctx, cred)
+		if err != nil {
+			fail(redir, w, r, err)
 			return
 		}
-		decoded, err := decode(vals[0])
+		s, err := j.loadOne(ctx, key, tok)
+		if errors.Is(err, ErrInvalidKey) {
+			err = ErrMalformedCookie
+		}
 		if err != nil {
-			redir.ServeHTTP(w, r)
+			fail(redir, w, r, err)
 			return
 		}
-		ctx := r.Context()
-		s, err := j.loadOne(ctx, decoded, []byte(vals[1]))
-		if err != nil {
-			redir.ServeHTTP(w, r)
-		} else {
-			r = r.WithContext(context.WithValue(ctx, sessionKey, s))
-			wrap.ServeHTTP(w, r)
+		// A failed rotation or renewal leaves the session valid as it is, so
+		// carry on with the request regardless.  Only cookies can be rotated,
+		// since other credentials have no way to receive the new token.
+		//
+		// A token the session was just rotated from is accepted during the
+		// grace window, but must never be issued again, or the client would
+		// present it after the window and revoke its own session.  The
+		// current token isn't known here, so such requests are served with
+		// the session as it is, leaving renewal to the client's next request
+		// with the current token.
+		current := bytes.Equal(s.Token, digest(tok))
+		value, reissue, rotated := cred, false, false
+		if current && !bytes.Equal(s.Key, key) {
+			// The key was renamed, so point the credential at the new one.
+			if !opaque(value) {
+				value = j.value(s.Key, string(tok))
+			}
+			reissue = true
+		}
+		if current && fromCookie && j.rotateAge != 0 && now().Sub(s.Issued) >= j.rotateAge {
+			// As in Rotate, the new token's lookup is stored first, so the
+			// session is never rotated to a token the client can't be given.
+			secure := genRandomString(tokenSize)
+			if !j.opaque || j.link(ctx, s.Key, secure, s.Exp) == nil {
+				if rs, err := j.rotate(ctx, s, []byte(secure)); err == nil {
+					s, value, reissue, rotated = rs, j.value(s.Key, secure), true, true
+				}
+			}
+		}
+		if rs, ok := j.renewal(s); ok && current {
+			if err := j.extend(ctx, rs); err == nil {
+				s, reissue = rs, true
+			}
+		}
+		if j.seenEvery != 0 && now().Sub(s.LastSeen) >= j.seenEvery {
+			s.LastSeen = now()
+			j.touch(s)
 		}
+		// The lookup for an opaque token has to live as long as its session.
+		// A rotated token is sent regardless, since the old one has been
+		// rotated out, and its lookup lasts at least until the old expiry.
+		if reissue && opaque(value) && j.link(ctx, s.Key, value, s.Exp) != nil && !rotated {
+			reissue = false
+		}
+		if reissue && fromCookie {
+			http.SetCookie(w, j.cookie(value, s.Exp))
+		}
+		r = r.WithContext(context.WithValue(ctx, sessionKey, s))
+		wrap.ServeHTTP(w, r)
 	})
 }
 
-// Set the session cookie on the response.  Call after successful
-// authentication / login.  meta optional parameter sets metadata in the
-// session storage.
-func (j *Jeff) Set(ctx context.Context, w http.ResponseWriter, key []byte, meta ...[]byte) error {
-	if len(meta) > 1 {
-		panic("meta must not be longer than 1")
+// Parse extracts the session key and token from a cookie value or other
+// credential in either format, looking up the key of opaque ones in the
+// Storage.  It doesn't check that the session exists.  It's meant for
+// debugging and tools; handlers should use Wrap or Public.
+func (j *Jeff) Parse(ctx context.Context, value string) ([]byte, []byte, error) {
+	if value == clearedValue {
+		// A cleared cookie the browser kept is the same as none.
+		return nil, nil, ErrNoCookie
+	}
+	if opaque(value) {
+		// Values which can't be a token, such as the one Clear sets, aren't
+		// looked up, sparing the backend a read.
+		if _, err := decode(value); err != nil || len(value) != base64.RawURLEncoding.EncodedLen(tokenSize) {
+			return nil, nil, ErrMalformedCookie
+		}
+		key, err := j.lookup(ctx, value)
+		return key, []byte(value), err
+	}
+	vals := strings.SplitN(value, separator, 2)
+	if vals[1] == "" {
+		return nil, nil, ErrMalformedCookie
+	}
+	decoded, err := decode(vals[0])
+	if err != nil {
+		return nil, nil, ErrInvalidEncoding
+	}
+	if len(decoded) == 0 {
+		return nil, nil, ErrMalformedCookie
+	}
+	return decoded, []byte(vals[1]), nil
+}
+
+// renewal returns the session with its expiration pushed forward if it's due
+// for renewal, and whether it was.
+func (j *Jeff) renewal(s Session) (Session, bool) {
+	threshold := j.renew
+	if threshold == 0 {
+		threshold = j.idle / 2
+	}
+	if threshold == 0 || s.Exp.Sub(now()) >= threshold {
+		return s, false
+	}
+	exp := j.expiration(s.MaxExp)
+	if !exp.After(s.Exp) {
+		return s, false
+	}
+	s.Exp = exp
+	return s, true
+}
+
+// expiration returns the time a session granted now should expire, capped at
+// max if it's set.
+func (j *Jeff) expiration(max time.Time) time.Time {
+	var exp time.Time
+	switch {
+	case j.idle != 0:
+		exp = now().Add(j.idle)
+	case j.expires != 0:
+		exp = now().Add(j.expires)
+	default:
+		// For session cookies which expire "when the browser closes"
+		exp = now().Add(30 * 24 * time.Hour)
 	}
-	secure := genRandomString(24) // 192 bits
+	if !max.IsZero() && exp.After(max) {
+		exp = max
+	}
+	return exp
+}
+
+// cookie returns the session cookie carrying value.  The cookie expires at exp
+// unless Expires is 0, in which case it's a session cookie.
+func (j *Jeff) cookie(value string, exp time.Time) *http.Cookie {
 	c := &http.Cookie{
 		Secure:   !j.insecure,
 		HttpOnly: true,
 		Name:     j.cookieName,
-		Value:    strings.Join([]string{encode(key), secure}, separator),
+		Value:    value,
 		Path:     j.path,
 		Domain:   j.domain,
 		SameSite: j.samesite,
 	}
-	var exp time.Time
 	if j.expires != 0 {
-		exp = now().Add(j.expires)
 		c.Expires = exp
-	} else {
-		// For session cookies which expire "when the browser closes"
-		exp = now().Add(30 * 24 * time.Hour)
 	}
-	http.SetCookie(w, c)
+	return c
+}
+
+// Set the session cookie on the response.  Call after successful
+// authentication / login.  meta optional parameter sets metadata in the
+// session storage.  The client's IP, User-Agent and device label are recorded
+// with the session if ctx carries them; see WithClient and WithDevice.
+func (j *Jeff) Set(ctx context.Context, w http.ResponseWriter, key []byte, meta ...[]byte) error {
+	value, exp, err := j.issue(ctx, key, meta...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, j.cookie(value, exp))
+	return nil
+}
+
+// Issue starts a session like Set, but returns the credential instead of
+// setting a cookie.  Native apps and CLIs can then present it in an
+// Authorization header; see Bearer.
+func (j *Jeff) Issue(ctx context.Context, key []byte, meta ...[]byte) (string, error) {
+	value, _, err := j.issue(ctx, key, meta...)
+	return value, err
+}
+
+func (j *Jeff) issue(ctx context.Context, key []byte, meta ...[]byte) (string, time.Time, error) {
+	if len(meta) > 1 {
+		panic("meta must not be longer than 1")
+	}
+	secure := genRandomString(tokenSize)
+	var max time.Time
+	if j.lifetime != 0 {
+		max = now().Add(j.lifetime)
+	}
+	exp := j.expiration(max)
+	if j.opaque {
+		if err := j.link(ctx, key, secure, exp); err != nil {
+			return "", time.Time{}, err
+		}
+	}
 	var m []byte
 	if len(meta) == 1 {
 		m = meta[0]
 	}
-	return j.store(ctx, Session{
-		Key:   key,
-		Token: []byte(secure),
-		Exp:   exp,
-		Meta:  m,
+	c, _ := ctx.Value(clientKey).(client)
+	err := j.store(ctx, Session{
+		Key:       key,
+		Token:     digest([]byte(secure)),
+		Exp:       exp,
+		MaxExp:    max,
+		Issued:    now(),
+		Hashed:    true,
+		CSRF:      genRandomBytes(csrfSize),
+		Meta:      m,
+		Created:   now(),
+		LastSeen:  now(),
+		IP:        c.ip,
+		UserAgent: c.userAgent,
+		Device:    c.device,
 	})
+	return j.value(key, secure), exp, err
+}
+
+// Rotate replaces the token of the active session with a new one and sets the
+// cookie on the response, keeping the session's key, metadata and expiration.
+// Call it after privilege changes, such as a user confirming their password,
+// so a token captured beforehand isn't worth as much.  The old token remains
+// valid for the RotationGrace window.
+func (j *Jeff) Rotate(ctx context.Context, w http.ResponseWriter) error {
+	s := ActiveSession(ctx)
+	if len(s.Key) == 0 {
+		return ErrNoActiveSession
+	}
+	secure := genRandomString(tokenSize)
+	if j.opaque {
+		if err := j.link(ctx, s.Key, secure, s.Exp); err != nil {
+			return err
+		}
+	}
+	s, err := j.rotate(ctx, s, []byte(secure))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, j.cookie(j.value(s.Key, secure), s.Exp))
+	return nil
 }
 
 // Clear the session in the context for the given key.
 func (j *Jeff) Clear(ctx context.Context, w http.ResponseWriter) error {
 	s := ActiveSession(ctx)
-	c := &http.Cookie{
-		Secure:   !j.insecure,
-		HttpOnly: true,
-		Name:     j.cookieName,
-		Value:    "deleted",
-		Path:     j.path,
-		Domain:   j.domain,
-		Expires:  time.Time{},
-	}
+	c := j.cookie(clearedValue, time.Time{})
+	c.MaxAge = -1
 	http.SetCookie(w, c)
 	if len(s.Key) > 0 {
 		// TODO: a bit worried about corrupt (empty) tokens.
@@ -237,11 +543,57 @@ func (j *Jeff) Clear(ctx context.Context, w http.ResponseWriter) error {
 	return nil
 }
 
+// RevokeOthers deletes every session for the key of the active session except
+// the active session itself, in a single write.  Call it after a password
+// change to log the user out everywhere but the browser they're using.
+func (j *Jeff) RevokeOthers(ctx context.Context) error {
+	s := ActiveSession(ctx)
+	if len(s.Key) == 0 {
+		return ErrNoActiveSession
+	}
+	return j.revokeOthers(ctx, s.Key, s.Token)
+}
+
+// RevokeOthersForKey is like RevokeOthers for use outside of a request, such
+// as in background jobs.  It deletes every session for key except the one
+// with the token keep, given as handed to the client or as stored.  If no
+// session has that token, all of them are deleted.
+func (j *Jeff) RevokeOthersForKey(ctx context.Context, key, keep []byte) error {
+	return j.revokeOthers(ctx, key, keep)
+}
+
 // Delete the session for the given key.
 func (j *Jeff) Delete(ctx context.Context, key []byte, tokens ...[]byte) error {
 	return j.clear(ctx, key, tokens...)
 }
 
+// Extend sets the expiration of the unexpired sessions for the given key to
+// exp, or of the selected sessions if a list of tokens is given.  Tokens may
+// be given as handed to the client or as stored.  A MaxLifetime earlier than
+// exp is moved to exp.  The lookups of sessions with Opaque cookies are
+// extended along with them.
+func (j *Jeff) Extend(ctx context.Context, key []byte, exp time.Time, tokens ...[]byte) error {
+	var extended SessionList
+	err := j.update(ctx, key, func(sl SessionList) SessionList {
+		extended = extended[:0]
+		for i := range sl {
+			if sl[i].Exp.Before(now()) || len(tokens) > 0 && !selected(sl[i], tokens) {
+				continue
+			}
+			sl[i].Exp = exp
+			if !sl[i].MaxExp.IsZero() && sl[i].MaxExp.Before(exp) {
+				sl[i].MaxExp = exp
+			}
+			extended = append(extended, sl[i])
+		}
+		return sl
+	})
+	if err != nil {
+		return err
+	}
+	return j.relink(ctx, extended)
+}
+
 // ActiveSession returns the currently active session on the context. If there
 // is no active session on the context, it returns an empty session object.
 func ActiveSession(ctx context.Context) Session {
@@ -267,6 +619,12 @@ func (j *Jeff) defaults() {
 	if j.path == "" {
 		j.path = "/"
 	}
+	if j.extractors == nil {
+		j.extractors = []Extractor{FromCookie(j.cookieName)}
+		if j.bearer {
+			j.extractors = append(j.extractors, FromBearer)
+		}
+	}
 }
 
 // From: https://blog.questionable.services/article/generating-secure-random-numbers-crypto-rand/
@@ -293,6 +651,19 @@ func genRandomBytes(n int) []byte {
 	return b
 }
 
+// value returns the cookie value for the session in the configured format.
+func (j *Jeff) value(key []byte, token string) string {
+	if j.opaque {
+		return token
+	}
+	return strings.Join([]string{encode(key), token}, separator)
+}
+
+// opaque reports whether the cookie value carries only the session token.
+func opaque(value string) bool {
+	return !strings.Contains(value, separator)
+}
+
 func encode(b []byte) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
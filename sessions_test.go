@@ -1,14 +1,21 @@
 package jeff_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/internal/storetest"
 	memcache_store "github.com/abraithwaite/jeff/memcache"
 	"github.com/abraithwaite/jeff/memory"
 	redis_store "github.com/abraithwaite/jeff/redis"
@@ -64,6 +71,20 @@ func TestMemoryExpires(t *testing.T) {
 	SuiteExpires(t, memory.New())
 }
 
+// slowFetch widens the window between reading and writing a SessionList so
+// that lost updates show up reliably when the store isn't atomic.
+type slowFetch struct{ *memory.Memory }
+
+func (s slowFetch) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	v, err := s.Memory.Fetch(ctx, key)
+	time.Sleep(time.Millisecond)
+	return v, err
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	SuiteConcurrent(t, slowFetch{memory.New()})
+}
+
 func TestMemcache(t *testing.T) {
 	mcc := memcache.New("localhost:11211")
 	str := memcache_store.New(mcc)
@@ -76,6 +97,12 @@ func TestMemcacheExpires(t *testing.T) {
 	SuiteExpires(t, str)
 }
 
+func TestMemcacheConcurrent(t *testing.T) {
+	mcc := memcache.New("localhost:11211")
+	str := memcache_store.New(mcc)
+	SuiteConcurrent(t, str)
+}
+
 func TestRedis(t *testing.T) {
 	p := &redis.Pool{
 		MaxIdle:     3,
@@ -96,6 +123,76 @@ func TestRedisExpires(t *testing.T) {
 	SuiteExpires(t, str)
 }
 
+func TestRedisConcurrent(t *testing.T) {
+	p := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", "localhost:6379") },
+	}
+	str := redis_store.New(p)
+	SuiteConcurrent(t, str)
+}
+
+func TestDynamoDB(t *testing.T) {
+	Suite(t, storetest.DynamoDB(t))
+}
+
+func TestDynamoDBExpires(t *testing.T) {
+	SuiteExpires(t, storetest.DynamoDB(t))
+}
+
+func TestDynamoDBConcurrent(t *testing.T) {
+	SuiteConcurrent(t, storetest.DynamoDB(t))
+}
+
+func TestMongo(t *testing.T) {
+	Suite(t, storetest.Mongo(t))
+}
+
+func TestMongoExpires(t *testing.T) {
+	SuiteExpires(t, storetest.Mongo(t))
+}
+
+func TestMongoConcurrent(t *testing.T) {
+	SuiteConcurrent(t, storetest.Mongo(t))
+}
+
+func TestBolt(t *testing.T) {
+	Suite(t, storetest.Bolt(t))
+}
+
+func TestBoltExpires(t *testing.T) {
+	SuiteExpires(t, storetest.Bolt(t))
+}
+
+func TestBoltConcurrent(t *testing.T) {
+	SuiteConcurrent(t, storetest.Bolt(t))
+}
+
+func TestFile(t *testing.T) {
+	Suite(t, storetest.File(t, storetest.TempDir(t)))
+}
+
+func TestFileExpires(t *testing.T) {
+	SuiteExpires(t, storetest.File(t, storetest.TempDir(t)))
+}
+
+func TestFileConcurrent(t *testing.T) {
+	SuiteConcurrent(t, storetest.File(t, storetest.TempDir(t)))
+}
+
+func TestSQL(t *testing.T) {
+	Suite(t, storetest.SQLite(t))
+}
+
+func TestSQLExpires(t *testing.T) {
+	SuiteExpires(t, storetest.SQLite(t))
+}
+
+func TestSQLConcurrent(t *testing.T) {
+	SuiteConcurrent(t, storetest.SQLite(t))
+}
+
 func Suite(t *testing.T, store jeff.Storage) {
 	exp := 10 * 24 * time.Hour
 	j := jeff.New(store,
@@ -370,6 +467,71 @@ func SuiteExpires(t *testing.T, store jeff.Storage) {
 	assert.NoError(t, err)
 }
 
+func SuiteConcurrent(t *testing.T, store jeff.Storage) {
+	const n = 50
+	j := jeff.New(store, jeff.Expires(time.Hour))
+	key := []byte("concurrent@example.com")
+	ctx := context.Background()
+
+	jeff.SetTime(func() time.Time { return time.Now() })
+
+	// login runs in goroutines, so it can't stop the test with require.
+	login := func() {
+		w := httptest.NewRecorder()
+		err := j.Set(ctx, w, key)
+		assert.NoError(t, err)
+		cookies := w.Result().Cookies()
+		if assert.Equal(t, 1, len(cookies), "login should set cookie") {
+			vals := strings.SplitN(cookies[0].Value, "::", 2)
+			assert.Equal(t, 2, len(vals), "invalid cookie value")
+		}
+	}
+
+	t.Run("concurrent logins", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				login()
+			}()
+		}
+		wg.Wait()
+		sessions, err := j.SessionsForKey(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, n, len(sessions), "no login should be lost")
+	})
+
+	t.Run("concurrent logins and logouts", func(t *testing.T) {
+		sessions, err := j.SessionsForKey(ctx, key)
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for _, s := range sessions {
+			wg.Add(2)
+			go func(tok []byte) {
+				defer wg.Done()
+				assert.NoError(t, j.Delete(ctx, key, tok))
+			}(s.Token)
+			go func() {
+				defer wg.Done()
+				login()
+			}()
+		}
+		wg.Wait()
+		remaining, err := j.SessionsForKey(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, n, len(remaining), "no login or logout should be lost")
+		for _, s := range sessions {
+			for _, r := range remaining {
+				assert.NotEqual(t, s.Token, r.Token, "deleted session should not be resurrected")
+			}
+		}
+	})
+
+	err := j.Delete(ctx, key)
+	assert.NoError(t, err)
+}
+
 func TestInsecure(t *testing.T) {
 	j := jeff.New(memory.New(), jeff.Insecure)
 	s := &server{j: j, t: t}
@@ -401,3 +563,885 @@ func TestSessCookie(t *testing.T) {
 	cookie := cookies[0]
 	assert.True(t, cookie.Expires.IsZero(), "cookie expiration not set (session cookie)")
 }
+
+func TestClearCookie(t *testing.T) {
+	j := jeff.New(memory.New())
+	w := httptest.NewRecorder()
+	require.NoError(t, j.Clear(context.Background(), w))
+	cookies := w.Result().Cookies()
+	require.Equal(t, 1, len(cookies), "clear should set cookie")
+	assert.True(t, cookies[0].MaxAge < 0, "cleared cookie should be deleted by the browser")
+
+	// Browsers which keep the cookie anyway are treated as logged out.
+	_, _, err := j.Parse(context.Background(), cookies[0].Value)
+	assert.Equal(t, jeff.ErrNoCookie, err)
+}
+
+// ttlStore records the backend expiration of the last write.
+type ttlStore struct {
+	*memory.Memory
+	exp time.Time
+}
+
+func (s *ttlStore) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	return s.Memory.Update(ctx, key, func(v []byte) ([]byte, time.Time, error) {
+		value, exp, err := fn(v)
+		s.exp = exp
+		return value, exp, err
+	})
+}
+
+func get(h http.Handler, path string, cookie *http.Cookie) *http.Response {
+	req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func expirySetup(t *testing.T, opts ...func(*jeff.Jeff)) (http.Handler, *http.Cookie) {
+	j := jeff.New(memory.New(), append([]func(*jeff.Jeff){jeff.Redirect(redir)}, opts...)...)
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.HandleFunc("/login", s.login)
+	resp := get(r, "/login", nil)
+	cookies := resp.Cookies()
+	require.Equal(t, 1, len(cookies), "login should set cookie")
+	return r, cookies[0]
+}
+
+func TestIdleTimeout(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	r, cookie := expirySetup(t, jeff.IdleTimeout(time.Hour))
+	assert.Equal(t, rec.Add(time.Hour), cookie.Expires, "idle timeout should set cookie lifetime")
+
+	jeff.SetTime(func() time.Time { return rec.Add(20 * time.Minute) })
+	resp := get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	assert.Equal(t, 0, len(resp.Cookies()), "session shouldn't renew above threshold")
+
+	jeff.SetTime(func() time.Time { return rec.Add(40 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	require.Equal(t, 1, len(resp.Cookies()), "session should renew below threshold")
+	assert.Equal(t, rec.Add(100*time.Minute), resp.Cookies()[0].Expires, "renewal should slide expiration")
+	assert.Equal(t, cookie.Value, resp.Cookies()[0].Value, "renewal should keep the session")
+
+	jeff.SetTime(func() time.Time { return rec.Add(90 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "renewed session should be valid")
+
+	jeff.SetTime(func() time.Time { return rec.Add(4 * time.Hour) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "idle session should expire")
+}
+
+func TestMaxLifetime(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	r, cookie := expirySetup(t, jeff.IdleTimeout(time.Hour), jeff.MaxLifetime(90*time.Minute))
+
+	jeff.SetTime(func() time.Time { return rec.Add(45 * time.Minute) })
+	resp := get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	require.Equal(t, 1, len(resp.Cookies()), "session should renew below threshold")
+	assert.Equal(t, rec.Add(90*time.Minute), resp.Cookies()[0].Expires, "renewal should stop at max lifetime")
+
+	jeff.SetTime(func() time.Time { return rec.Add(80 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	assert.Equal(t, 0, len(resp.Cookies()), "session shouldn't renew past max lifetime")
+
+	jeff.SetTime(func() time.Time { return rec.Add(91 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "session should expire at max lifetime")
+}
+
+func TestRenewWithin(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	r, cookie := expirySetup(t, jeff.Expires(24*time.Hour), jeff.RenewWithin(time.Hour))
+
+	jeff.SetTime(func() time.Time { return rec.Add(22 * time.Hour) })
+	resp := get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	assert.Equal(t, 0, len(resp.Cookies()), "session shouldn't renew above threshold")
+
+	jeff.SetTime(func() time.Time { return rec.Add(23*time.Hour + 30*time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "active session should be valid")
+	require.Equal(t, 1, len(resp.Cookies()), "session should renew below threshold")
+	assert.Equal(t, rec.Add(47*time.Hour+30*time.Minute), resp.Cookies()[0].Expires, "renewal should extend by Expires")
+
+	jeff.SetTime(func() time.Time { return rec.Add(30 * time.Hour) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "renewed session should be valid")
+}
+
+func TestBackendTTL(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	str := &ttlStore{Memory: memory.New()}
+	j := jeff.New(str, jeff.Expires(60*24*time.Hour))
+	ctx := context.Background()
+
+	err := j.Set(ctx, httptest.NewRecorder(), email)
+	require.NoError(t, err)
+	assert.Equal(t, rec.Add(60*24*time.Hour), str.exp, "backend should keep list as long as its sessions")
+
+	jeff.SetTime(func() time.Time { return rec.Add(time.Hour) })
+	err = j.Set(ctx, httptest.NewRecorder(), email)
+	require.NoError(t, err)
+	assert.Equal(t, rec.Add(60*24*time.Hour+time.Hour), str.exp, "backend ttl should follow the longest-lived session")
+
+	sessions, err := j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	err = j.Delete(ctx, email, sessions[1].Token)
+	require.NoError(t, err)
+	assert.WithinDuration(t, rec.Add(60*24*time.Hour), str.exp, 0, "backend ttl should shrink with the longest-lived session")
+}
+
+func TestRotateEvery(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	r, cookie := expirySetup(t, jeff.RotateEvery(10*time.Minute), jeff.RotationGrace(time.Minute))
+
+	jeff.SetTime(func() time.Time { return rec.Add(5 * time.Minute) })
+	resp := get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "fresh session should be valid")
+	assert.Equal(t, 0, len(resp.Cookies()), "fresh session shouldn't rotate")
+
+	jeff.SetTime(func() time.Time { return rec.Add(11 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "old session should be valid")
+	require.Equal(t, 1, len(resp.Cookies()), "old session should rotate")
+	rotated := resp.Cookies()[0]
+	assert.NotEqual(t, cookie.Value, rotated.Value, "rotation should issue a new token")
+	assert.Equal(t, cookie.Expires, rotated.Expires, "rotation should keep expiration")
+
+	jeff.SetTime(func() time.Time { return rec.Add(11*time.Minute + 30*time.Second) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "rotated-out token should be valid during grace")
+	assert.Equal(t, 0, len(resp.Cookies()), "rotated-out token shouldn't rotate again")
+	resp = get(r, "/authenticated", rotated)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new token should be valid")
+
+	jeff.SetTime(func() time.Time { return rec.Add(13 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "rotated-out token should be rejected after grace")
+	resp = get(r, "/authenticated", rotated)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "reuse should revoke the whole session")
+}
+
+func TestRotateRenewGrace(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	r, cookie := expirySetup(t, jeff.IdleTimeout(10*time.Minute), jeff.RotateEvery(time.Minute))
+
+	// One tab rotates the token while another still has the old one.
+	jeff.SetTime(func() time.Time { return rec.Add(4*time.Minute + 50*time.Second) })
+	resp := get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "session should be valid")
+	require.Equal(t, 1, len(resp.Cookies()), "session should rotate")
+	rotated := resp.Cookies()[0]
+
+	// The session is now due for renewal, but the old token mustn't be
+	// handed out again.
+	jeff.SetTime(func() time.Time { return rec.Add(5*time.Minute + 10*time.Second) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "rotated-out token should be valid during grace")
+	for _, c := range resp.Cookies() {
+		assert.NotEqual(t, cookie.Value, c.Value, "rotated-out token shouldn't be re-issued")
+	}
+
+	jeff.SetTime(func() time.Time { return rec.Add(6*time.Minute + 30*time.Second) })
+	resp = get(r, "/authenticated", rotated)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new token should be valid after grace")
+	require.Equal(t, 1, len(resp.Cookies()), "new token should renew")
+	assert.NotEqual(t, cookie.Value, resp.Cookies()[0].Value, "renewal shouldn't bring back the old token")
+	assert.Equal(t, rec.Add(16*time.Minute+30*time.Second), resp.Cookies()[0].Expires, "renewal should slide expiration")
+}
+
+// failLinks fails to store the lookups of opaque tokens once fail is set.
+type failLinks struct {
+	*memory.Memory
+	fail bool
+}
+
+func (s *failLinks) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	if s.fail && bytes.HasPrefix(key, []byte("jeff:id:")) {
+		return errDown
+	}
+	return s.Memory.Store(ctx, key, value, exp)
+}
+
+func TestRotateEveryFailedLink(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	str := &failLinks{Memory: memory.New()}
+	j := jeff.New(str, jeff.Redirect(redir), jeff.Opaque,
+		jeff.RotateEvery(10*time.Minute), jeff.RotationGrace(time.Minute))
+	h := j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	require.NoError(t, j.Set(context.Background(), w, email))
+	cookie := w.Result().Cookies()[0]
+
+	str.fail = true
+	jeff.SetTime(func() time.Time { return rec.Add(11 * time.Minute) })
+	resp := get(h, "/", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "session should be valid")
+	assert.Equal(t, 0, len(resp.Cookies()), "token shouldn't rotate without its lookup")
+
+	str.fail = false
+	jeff.SetTime(func() time.Time { return rec.Add(13 * time.Minute) })
+	resp = get(h, "/", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "token should still be current after grace")
+	sl, err := j.SessionsForKey(context.Background(), email)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl), "session shouldn't be revoked as reused")
+}
+
+func TestRotate(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	j := jeff.New(memory.New(), jeff.Redirect(redir))
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.Handle("/rotate", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, j.Rotate(r.Context(), w))
+	})))
+	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, j.Set(r.Context(), w, email, []byte("meta")))
+	})
+	r.Handle("/meta", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, []byte("meta"), jeff.ActiveSession(r.Context()).Meta, "rotation should keep meta")
+	})))
+
+	resp := get(r, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+
+	resp = get(r, "/rotate", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "rotate should succeed")
+	require.Equal(t, 1, len(resp.Cookies()), "rotate should set cookie")
+	rotated := resp.Cookies()[0]
+	assert.NotEqual(t, cookie.Value, rotated.Value, "rotation should issue a new token")
+
+	resp = get(r, "/meta", rotated)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new token should be valid")
+
+	sessions, err := j.SessionsForKey(context.Background(), email)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sessions), "rotation should keep a single session")
+
+	jeff.SetTime(func() time.Time { return rec.Add(2 * time.Minute) })
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "rotated-out token should be rejected after grace")
+	sessions, err = j.SessionsForKey(context.Background(), email)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(sessions), "reuse should revoke the session")
+}
+
+func TestOpaque(t *testing.T) {
+	jeff.SetTime(func() time.Time { return time.Now() })
+	str := memory.New()
+	j := jeff.New(str, jeff.Redirect(redir), jeff.Opaque)
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.HandleFunc("/login", s.login)
+	r.Handle("/rotate", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, j.Rotate(r.Context(), w))
+	})))
+
+	resp := get(r, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+	assert.NotContains(t, cookie.Value, "::", "opaque cookie shouldn't carry the key")
+	assert.NotContains(t, cookie.Value, base64.RawURLEncoding.EncodeToString(email), "opaque cookie shouldn't carry the key")
+
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "opaque cookie should be valid")
+
+	t.Run("legacy cookie", func(t *testing.T) {
+		legacy := jeff.New(str)
+		w := httptest.NewRecorder()
+		require.NoError(t, legacy.Set(context.Background(), w, email))
+		resp := get(r, "/authenticated", w.Result().Cookies()[0])
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "legacy cookie should stay valid")
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		resp := get(r, "/rotate", cookie)
+		require.Equal(t, 1, len(resp.Cookies()), "rotate should set cookie")
+		rotated := resp.Cookies()[0]
+		assert.NotContains(t, rotated.Value, "::", "opaque cookie shouldn't carry the key")
+		resp = get(r, "/authenticated", rotated)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "rotated opaque cookie should be valid")
+	})
+
+	t.Run("sessions by key", func(t *testing.T) {
+		sessions, err := j.SessionsForKey(context.Background(), email)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(sessions), "opaque sessions should be listed by key")
+		require.NoError(t, j.Delete(context.Background(), email))
+		resp := get(r, "/authenticated", cookie)
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "deleted opaque session should be invalid")
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		resp := get(r, "/authenticated", &http.Cookie{Name: "_gosession", Value: "bogus"})
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "unknown opaque token should be invalid")
+	})
+}
+
+func TestHashedTokens(t *testing.T) {
+	jeff.SetTime(func() time.Time { return time.Now() })
+	str := memory.New()
+	j := jeff.New(str, jeff.Redirect(redir))
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.HandleFunc("/login", s.login)
+	ctx := context.Background()
+
+	t.Run("stored as digest", func(t *testing.T) {
+		resp := get(r, "/login", nil)
+		require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+		tok := strings.SplitN(resp.Cookies()[0].Value, "::", 2)[1]
+		stored, err := str.Fetch(ctx, email)
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), tok, "token shouldn't be stored in plaintext")
+		sessions, err := j.SessionsForKey(ctx, email)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(sessions))
+		sum := sha256.Sum256([]byte(tok))
+		assert.Equal(t, sum[:], sessions[0].Token, "token should be stored as its digest")
+		require.NoError(t, j.Delete(ctx, email, sessions[0].Token))
+		resp = get(r, "/authenticated", resp.Cookies()[0])
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "delete should accept stored tokens")
+	})
+
+	t.Run("plaintext upgrade", func(t *testing.T) {
+		tok := "plaintext-token-from-older-version"
+		sl := jeff.SessionList{{
+			Key:   email,
+			Token: []byte(tok),
+			Exp:   time.Now().Add(time.Hour),
+		}}
+		bts, err := sl.MarshalMsg(nil)
+		require.NoError(t, err)
+		require.NoError(t, str.Store(ctx, email, bts, time.Now().Add(time.Hour)))
+		cookie := &http.Cookie{
+			Name:  "_gosession",
+			Value: base64.RawURLEncoding.EncodeToString(email) + "::" + tok,
+		}
+
+		resp := get(r, "/authenticated", cookie)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "plaintext session should stay valid")
+
+		get(r, "/login", nil)
+		stored, err := str.Fetch(ctx, email)
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), tok, "plaintext token should be hashed on write")
+		resp = get(r, "/authenticated", cookie)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "upgraded session should stay valid")
+
+		require.NoError(t, j.Delete(ctx, email, []byte(tok)))
+		resp = get(r, "/authenticated", cookie)
+		assert.Equal(t, http.StatusFound, resp.StatusCode, "delete should accept raw tokens")
+	})
+}
+
+func TestMapKey(t *testing.T) {
+	jeff.SetTime(func() time.Time { return time.Now() })
+	str := memory.New()
+	mapping := jeff.HashKey("sessions:")
+	j := jeff.New(str, jeff.Redirect(redir), jeff.MapKey(mapping))
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.HandleFunc("/login", s.login)
+	ctx := context.Background()
+
+	resp := get(r, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+
+	stored, err := str.Fetch(ctx, email)
+	require.NoError(t, err)
+	assert.Nil(t, stored, "session key shouldn't reach the backend")
+	mapped := mapping(email)
+	assert.True(t, strings.HasPrefix(string(mapped), "sessions:"), "mapped key should be prefixed")
+	stored, err = str.Fetch(ctx, mapped)
+	require.NoError(t, err)
+	assert.NotNil(t, stored, "session should be stored under the mapped key")
+
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "session should be valid")
+
+	sessions, err := j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sessions))
+	assert.Equal(t, email, sessions[0].Key, "session should keep the original key")
+
+	require.NoError(t, j.Delete(ctx, email))
+	resp = get(r, "/authenticated", cookie)
+	assert.Equal(t, http.StatusFound, resp.StatusCode, "delete should use the mapped key")
+}
+
+// failStore fails every operation, as if the backend were down.
+type failStore struct{}
+
+var errDown = errors.New("backend down")
+
+func (failStore) Store(context.Context, []byte, []byte, time.Time) error { return errDown }
+func (failStore) Fetch(context.Context, []byte) ([]byte, error)          { return nil, errDown }
+func (failStore) Delete(context.Context, []byte) error                   { return errDown }
+
+// strictKeys rejects keys with spaces, as memcache does.
+type strictKeys struct{ *memory.Memory }
+
+func (s strictKeys) check(key []byte) error {
+	if bytes.ContainsRune(key, ' ') {
+		return jeff.ErrInvalidKey
+	}
+	return nil
+}
+
+func (s strictKeys) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.Memory.Store(ctx, key, value, exp)
+}
+
+func (s strictKeys) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	if err := s.check(key); err != nil {
+		return nil, err
+	}
+	return s.Memory.Fetch(ctx, key)
+}
+
+func (s strictKeys) Update(ctx context.Context, key []byte, fn func([]byte) ([]byte, time.Time, error)) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.Memory.Update(ctx, key, fn)
+}
+
+func TestFailureReason(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	var reason error
+	onFail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = jeff.FailureReason(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	str := memory.New()
+	j := jeff.New(str, jeff.Redirect(onFail), jeff.Expires(time.Hour))
+	s := &server{j: j, t: t}
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(s.authed)))
+	r.Handle("/public", j.Public(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = jeff.FailureReason(r.Context())
+	})))
+	r.HandleFunc("/login", s.login)
+
+	resp := get(r, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+	key := base64.RawURLEncoding.EncodeToString(email)
+
+	for _, tc := range []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"malformed", key + "::", jeff.ErrMalformedCookie},
+		{"empty key", "::token", jeff.ErrMalformedCookie},
+		{"malformed opaque", "not base64!", jeff.ErrMalformedCookie},
+		{"cleared", "deleted", jeff.ErrNoCookie},
+		{"invalid encoding", "not base64!::token", jeff.ErrInvalidEncoding},
+		{"not found", key + "::token", jeff.ErrSessionNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason = nil
+			resp := get(r, "/authenticated", &http.Cookie{Name: "_gosession", Value: tc.value})
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "failure handler should be called")
+			assert.Equal(t, tc.err, reason)
+		})
+	}
+
+	t.Run("no cookie", func(t *testing.T) {
+		reason = nil
+		get(r, "/authenticated", nil)
+		assert.Equal(t, jeff.ErrNoCookie, reason)
+	})
+
+	t.Run("authenticated", func(t *testing.T) {
+		reason = errDown
+		get(r, "/public", cookie)
+		assert.NoError(t, reason, "authenticated requests shouldn't have a failure reason")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		jeff.SetTime(func() time.Time { return rec.Add(2 * time.Hour) })
+		reason = nil
+		get(r, "/public", cookie)
+		assert.Equal(t, jeff.ErrSessionExpired, reason, "public handler should get failure reason")
+	})
+
+	t.Run("storage", func(t *testing.T) {
+		j := jeff.New(failStore{}, jeff.Redirect(onFail))
+		reason = nil
+		resp := get(j.Wrap(http.HandlerFunc(s.authed)), "/", cookie)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "failure handler should be called")
+		assert.True(t, errors.Is(reason, jeff.ErrStorage), "storage errors should be marked")
+		assert.True(t, errors.Is(reason, errDown), "storage errors should wrap the original")
+		err := j.Set(context.Background(), httptest.NewRecorder(), email)
+		assert.True(t, errors.Is(err, jeff.ErrStorage), "storage errors should be marked")
+
+		reason = nil
+		get(j.Wrap(http.HandlerFunc(s.authed)), "/", &http.Cookie{Name: "_gosession", Value: "deleted"})
+		assert.Equal(t, jeff.ErrNoCookie, reason, "cleared cookies shouldn't be looked up")
+		reason = nil
+		get(j.Wrap(http.HandlerFunc(s.authed)), "/", &http.Cookie{Name: "_gosession", Value: "short"})
+		assert.Equal(t, jeff.ErrMalformedCookie, reason, "values which can't be a token shouldn't be looked up")
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		j := jeff.New(strictKeys{memory.New()}, jeff.Redirect(onFail))
+		reason = nil
+		value := base64.RawURLEncoding.EncodeToString([]byte("a b")) + "::token"
+		resp := get(j.Wrap(http.HandlerFunc(s.authed)), "/", &http.Cookie{Name: "_gosession", Value: value})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "failure handler should be called")
+		assert.Equal(t, jeff.ErrMalformedCookie, reason, "keys the Storage rejects should be malformed")
+		err := j.Set(context.Background(), httptest.NewRecorder(), []byte("a b"))
+		assert.True(t, errors.Is(err, jeff.ErrInvalidKey))
+		assert.False(t, errors.Is(err, jeff.ErrStorage), "invalid keys aren't storage errors")
+	})
+}
+
+func TestTrackLastSeen(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	j := jeff.New(memory.New(), jeff.Redirect(redir), jeff.TrackLastSeen(time.Minute))
+	s := &server{j: j, t: t}
+	var seen time.Time
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = jeff.ActiveSession(r.Context()).LastSeen
+	})))
+	r.HandleFunc("/login", s.login)
+	resp := get(r, "/login", nil)
+	require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+	cookie := resp.Cookies()[0]
+	stored := func() time.Time {
+		sl, err := j.SessionsForKey(context.Background(), email)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(sl))
+		return sl[0].LastSeen
+	}
+	assert.WithinDuration(t, rec, stored(), 0, "login should count as seen")
+
+	jeff.SetTime(func() time.Time { return rec.Add(30 * time.Second) })
+	get(r, "/authenticated", cookie)
+	assert.WithinDuration(t, rec, seen, 0, "last seen shouldn't update within interval")
+
+	jeff.SetTime(func() time.Time { return rec.Add(2 * time.Minute) })
+	get(r, "/authenticated", cookie)
+	assert.WithinDuration(t, rec.Add(2*time.Minute), seen, 0, "context should carry the time of the request")
+	assert.Eventually(t, func() bool {
+		return stored().Equal(rec.Add(2 * time.Minute))
+	}, time.Second, 10*time.Millisecond, "last seen should be written in the background")
+}
+
+func TestExtend(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	ctx := context.Background()
+	j := jeff.New(memory.New(), jeff.Expires(time.Hour), jeff.MaxLifetime(2*time.Hour))
+	w := httptest.NewRecorder()
+	require.NoError(t, j.Set(ctx, w, email))
+	require.NoError(t, j.Set(ctx, httptest.NewRecorder(), email))
+	key, tok, err := j.Parse(ctx, w.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, email, key)
+
+	require.NoError(t, j.Extend(ctx, email, rec.Add(3*time.Hour), tok))
+	sl, err := j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sl))
+	assert.WithinDuration(t, rec.Add(3*time.Hour), sl[0].Exp, 0, "selected session should be extended")
+	assert.WithinDuration(t, rec.Add(3*time.Hour), sl[0].MaxExp, 0, "max lifetime shouldn't cut the extension short")
+	assert.WithinDuration(t, rec.Add(time.Hour), sl[1].Exp, 0, "other sessions should be untouched")
+
+	require.NoError(t, j.Extend(ctx, email, rec.Add(90*time.Minute)))
+	sl, err = j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	assert.WithinDuration(t, rec.Add(90*time.Minute), sl[0].Exp, 0)
+	assert.WithinDuration(t, rec.Add(90*time.Minute), sl[1].Exp, 0)
+}
+
+// expStore records the expiration of the last write of each key.
+type expStore struct {
+	*memory.Memory
+	exps map[string]time.Time
+}
+
+func (s *expStore) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	s.exps[string(key)] = exp
+	return s.Memory.Store(ctx, key, value, exp)
+}
+
+func TestExtendOpaque(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	ctx := context.Background()
+	str := &expStore{Memory: memory.New(), exps: map[string]time.Time{}}
+	j := jeff.New(str, jeff.Opaque, jeff.Expires(time.Hour))
+	w := httptest.NewRecorder()
+	require.NoError(t, j.Set(ctx, w, email))
+	_, tok, err := j.Parse(ctx, w.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	sum := sha256.Sum256(tok)
+	id := "jeff:id:" + hex.EncodeToString(sum[:])
+	require.WithinDuration(t, rec.Add(time.Hour), str.exps[id], 0)
+
+	require.NoError(t, j.Extend(ctx, email, rec.Add(3*time.Hour)))
+	assert.WithinDuration(t, rec.Add(3*time.Hour), str.exps[id], 0, "opaque lookups should be extended")
+	key, _, err := j.Parse(ctx, w.Result().Cookies()[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, email, key)
+}
+
+func TestRevokeOthers(t *testing.T) {
+	ctx := context.Background()
+	j := jeff.New(memory.New(), jeff.Redirect(redir))
+	var revoke func(context.Context) error
+	r := http.NewServeMux()
+	r.HandleFunc("/login", (&server{j: j, t: t}).login)
+	r.Handle("/revoke", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, revoke(r.Context()))
+	})))
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	login := func() *http.Cookie {
+		resp := get(r, "/login", nil)
+		require.Equal(t, 1, len(resp.Cookies()), "login should set cookie")
+		return resp.Cookies()[0]
+	}
+	a, b, c := login(), login(), login()
+
+	revoke = j.RevokeOthers
+	get(r, "/revoke", b)
+	assert.Equal(t, http.StatusOK, get(r, "/authenticated", b).StatusCode, "current session should be kept")
+	assert.Equal(t, http.StatusFound, get(r, "/authenticated", a).StatusCode, "other sessions should be revoked")
+	assert.Equal(t, http.StatusFound, get(r, "/authenticated", c).StatusCode, "other sessions should be revoked")
+	assert.Equal(t, jeff.ErrNoActiveSession, j.RevokeOthers(ctx))
+
+	d := login()
+	_, tok, err := j.Parse(ctx, d.Value)
+	require.NoError(t, err)
+	require.NoError(t, j.RevokeOthersForKey(ctx, email, tok))
+	assert.Equal(t, http.StatusOK, get(r, "/authenticated", d).StatusCode, "kept session should be valid")
+	assert.Equal(t, http.StatusFound, get(r, "/authenticated", b).StatusCode, "other sessions should be revoked")
+	sl, err := j.SessionsForKey(ctx, email)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl))
+}
+
+func TestInvalidateBefore(t *testing.T) {
+	rec := time.Now().UTC().Truncate(time.Second)
+	jeff.SetTime(func() time.Time { return rec })
+	ctx := context.Background()
+	str := memory.New()
+	var reason error
+	fail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason = jeff.FailureReason(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	j := jeff.New(str, jeff.Redirect(fail), jeff.Epochs)
+	r := http.NewServeMux()
+	r.Handle("/authenticated", j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	login := func(key string) *http.Cookie {
+		w := httptest.NewRecorder()
+		require.NoError(t, j.Set(ctx, w, []byte(key)))
+		return w.Result().Cookies()[0]
+	}
+	a := login("alice")
+	stale, err := str.Fetch(ctx, []byte("alice"))
+	require.NoError(t, err)
+	jeff.SetTime(func() time.Time { return rec.Add(time.Minute) })
+	b, c := login("alice"), login("carol")
+
+	require.NoError(t, j.InvalidateBefore(ctx, []byte("alice"), rec.Add(30*time.Second)))
+	assert.Equal(t, http.StatusUnauthorized, get(r, "/authenticated", a).StatusCode, "earlier sessions should be invalid")
+	assert.Equal(t, http.StatusOK, get(r, "/authenticated", b).StatusCode, "later sessions should be valid")
+	assert.Equal(t, http.StatusOK, get(r, "/authenticated", c).StatusCode, "other keys should be untouched")
+	sl, err := j.SessionsForKey(ctx, []byte("alice"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl), "invalidated sessions should be removed")
+
+	// A concurrent writer putting back a list read beforehand.
+	require.NoError(t, str.Store(ctx, []byte("alice"), stale, rec.Add(time.Hour)))
+	reason = nil
+	assert.Equal(t, http.StatusUnauthorized, get(r, "/authenticated", a).StatusCode, "resurrected sessions should be invalid")
+	assert.Equal(t, jeff.ErrSessionInvalidated, reason)
+
+	jeff.SetTime(func() time.Time { return rec.Add(2 * time.Minute) })
+	require.NoError(t, j.InvalidateAllBefore(ctx, rec.Add(time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, get(r, "/authenticated", b).StatusCode, "global epoch should apply to every key")
+	assert.Equal(t, http.StatusUnauthorized, get(r, "/authenticated", c).StatusCode, "global epoch should apply to every key")
+	jeff.SetTime(func() time.Time { return rec.Add(3 * time.Minute) })
+	assert.Equal(t, http.StatusOK, get(r, "/authenticated", login("carol")).StatusCode, "new sessions should be valid")
+}
+
+// countFetch counts the reads from the Storage.
+type countFetch struct {
+	*memory.Memory
+	n int
+}
+
+func (s *countFetch) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	s.n++
+	return s.Memory.Fetch(ctx, key)
+}
+
+func TestEpochs(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		opts  []func(*jeff.Jeff)
+		reads int
+	}{
+		{"Off", nil, 1},
+		{"On", []func(*jeff.Jeff){jeff.Epochs}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jeff.SetTime(func() time.Time { return time.Now() })
+			str := &countFetch{Memory: memory.New()}
+			j := jeff.New(str, append([]func(*jeff.Jeff){jeff.Redirect(redir)}, tc.opts...)...)
+			w := httptest.NewRecorder()
+			require.NoError(t, j.Set(ctx, w, email))
+			str.n = 0
+			resp := get(j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), "/", w.Result().Cookies()[0])
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.reads, str.n, "epochs should only be read when enabled")
+		})
+	}
+	j := jeff.New(memory.New())
+	assert.Equal(t, jeff.ErrNoEpochs, j.InvalidateBefore(ctx, email, time.Now()))
+	assert.Equal(t, jeff.ErrNoEpochs, j.InvalidateAllBefore(ctx, time.Now()))
+}
+
+func TestReservedKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []func(*jeff.Jeff)
+	}{
+		{"Default", nil},
+		{"MapKey", []func(*jeff.Jeff){jeff.MapKey(jeff.HashKey("sessions:"))}},
+		{"Opaque", []func(*jeff.Jeff){jeff.Opaque}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := time.Now().UTC().Truncate(time.Second)
+			jeff.SetTime(func() time.Time { return rec })
+			ctx := context.Background()
+			j := jeff.New(memory.New(), append([]func(*jeff.Jeff){jeff.Redirect(redir), jeff.Epochs}, tc.opts...)...)
+			h := j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			login := func(key []byte) *http.Cookie {
+				w := httptest.NewRecorder()
+				require.NoError(t, j.Set(ctx, w, key))
+				return w.Result().Cookies()[0]
+			}
+			require.NoError(t, j.InvalidateAllBefore(ctx, rec.Add(-time.Hour)))
+			require.NoError(t, j.InvalidateBefore(ctx, email, rec.Add(-time.Hour)))
+			victim := login(email)
+			oldKey := []byte("old@example.com")
+			renamed := login(oldKey)
+			require.NoError(t, j.RenameKey(ctx, oldKey, []byte("new@example.com")))
+
+			// Session keys which look like the keys of Jeff's own records.
+			sum := sha256.Sum256(email)
+			oldSum := sha256.Sum256(oldKey)
+			keys := [][]byte{
+				[]byte("jeff:nbf"),
+				[]byte("jeff:nbf:" + hex.EncodeToString(sum[:])),
+				[]byte("jeff:fwd:" + string(oldKey)),
+				[]byte("jeff:fwd:" + hex.EncodeToString(oldSum[:])),
+				[]byte("jeff:key:jeff:nbf"),
+			}
+			for _, key := range keys {
+				assert.Equal(t, http.StatusOK, get(h, "/", login(key)).StatusCode, "reserved-looking keys should work")
+			}
+			assert.Equal(t, http.StatusOK, get(h, "/", victim).StatusCode, "other sessions should be untouched")
+			assert.Equal(t, http.StatusOK, get(h, "/", renamed).StatusCode, "renamed keys should still be forwarded")
+			for _, key := range keys {
+				sl, err := j.SessionsForKey(ctx, key)
+				require.NoError(t, err)
+				assert.Equal(t, 1, len(sl), "keys shouldn't collide with each other")
+			}
+		})
+	}
+}
+
+func TestRenameKey(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []func(*jeff.Jeff)
+	}{
+		{"Default", nil},
+		{"Opaque", []func(*jeff.Jeff){jeff.Opaque}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			j := jeff.New(memory.New(), append([]func(*jeff.Jeff){jeff.Redirect(redir)}, tc.opts...)...)
+			oldKey, newKey := []byte("old@example.com"), []byte("new@example.com")
+			var active []byte
+			r := j.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				active = jeff.ActiveSession(r.Context()).Key
+			}))
+			login := func() *http.Cookie {
+				w := httptest.NewRecorder()
+				require.NoError(t, j.Set(ctx, w, oldKey))
+				return w.Result().Cookies()[0]
+			}
+			a, b := login(), login()
+
+			require.NoError(t, j.RenameKey(ctx, oldKey, newKey))
+			sl, err := j.SessionsForKey(ctx, oldKey)
+			require.NoError(t, err)
+			assert.Equal(t, 0, len(sl), "sessions should be moved")
+			sl, err = j.SessionsForKey(ctx, newKey)
+			require.NoError(t, err)
+			require.Equal(t, 2, len(sl), "sessions should be moved")
+			assert.Equal(t, newKey, sl[0].Key)
+
+			resp := get(r, "/", a)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "old credentials should be forwarded")
+			assert.Equal(t, newKey, active, "session should carry the new key")
+			require.Equal(t, 1, len(resp.Cookies()), "cookie should be re-issued")
+			renewed := resp.Cookies()[0]
+			if tc.name == "Default" {
+				assert.NotEqual(t, a.Value, renewed.Value, "cookie should carry the new key")
+			}
+			resp = get(r, "/", renewed)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "re-issued cookie should be valid")
+			assert.Equal(t, 0, len(resp.Cookies()), "re-issued cookie shouldn't be re-issued again")
+			assert.Equal(t, http.StatusOK, get(r, "/", b).StatusCode, "other devices should be forwarded")
+
+			// Renaming back makes the old key hold sessions again.
+			require.NoError(t, j.RenameKey(ctx, newKey, oldKey))
+			assert.Equal(t, http.StatusOK, get(r, "/", renewed).StatusCode, "renamed back sessions should be forwarded")
+			assert.Equal(t, oldKey, active)
+			assert.Equal(t, http.StatusOK, get(r, "/", b).StatusCode, "renamed back sessions should be valid")
+			assert.Equal(t, http.StatusFound, get(r, "/", &http.Cookie{Name: "_gosession", Value: "bm9wZQ::nope"}).StatusCode)
+		})
+	}
+}
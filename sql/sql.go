@@ -0,0 +1,439 @@
+package sql_store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+)
+
+var now = func() time.Time {
+	return time.Now()
+}
+
+// Dialect holds the SQL which differs between databases.  Queries are
+// written with ? placeholders and %[1]s in place of the table name.
+type Dialect struct {
+	// placeholder returns the placeholder for the nth (1-based) argument.
+	placeholder func(n int) string
+	// migrations create and update the schema, in order.
+	migrations []string
+	// lock and unlock take and release an advisory lock on the number given
+	// as their argument, held by the connection, so concurrent migrations
+	// wait for each other before creating any tables.  They're empty if the
+	// database serializes schema changes itself.
+	lock, unlock string
+	// insertVersion inserts the row of the version table, doing nothing if it
+	// exists.
+	insertVersion string
+	// insertSession inserts a session, doing nothing if it exists.
+	insertSession string
+	// upsert inserts a record, replacing any with the same key.
+	upsert string
+}
+
+func question(int) string { return "?" }
+
+// SQLite is the dialect for SQLite 3.24 and later.  SQLite allows one writer
+// at a time, so set a busy timeout on the connection, or limit the pool to a
+// single connection, to avoid "database is locked" errors under load.
+var SQLite = Dialect{
+	placeholder: question,
+	migrations: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			session_key BLOB NOT NULL,
+			session_id BLOB NOT NULL,
+			data BLOB NOT NULL,
+			exp INTEGER NOT NULL,
+			version INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (session_key, session_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_exp ON %[1]s (exp)`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_records (
+			record_key BLOB PRIMARY KEY,
+			data BLOB NOT NULL,
+			exp INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_records_exp ON %[1]s_records (exp)`,
+	},
+	insertVersion: `INSERT INTO %[1]s_version (id, version) VALUES (1, 0) ON CONFLICT (id) DO NOTHING`,
+	insertSession: `INSERT INTO %[1]s (session_key, session_id, data, exp) VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_key, session_id) DO NOTHING`,
+	upsert: `INSERT INTO %[1]s_records (record_key, data, exp) VALUES (?, ?, ?)
+		ON CONFLICT (record_key) DO UPDATE SET data = excluded.data, exp = excluded.exp`,
+}
+
+// Postgres is the dialect for PostgreSQL 9.5 and later.
+var Postgres = Dialect{
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	migrations: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			session_key BYTEA NOT NULL,
+			session_id BYTEA NOT NULL,
+			data BYTEA NOT NULL,
+			exp BIGINT NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (session_key, session_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_exp ON %[1]s (exp)`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_records (
+			record_key BYTEA PRIMARY KEY,
+			data BYTEA NOT NULL,
+			exp BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_records_exp ON %[1]s_records (exp)`,
+	},
+	lock:          `SELECT pg_advisory_lock(?)`,
+	unlock:        `SELECT pg_advisory_unlock(?)`,
+	insertVersion: `INSERT INTO %[1]s_version (id, version) VALUES (1, 0) ON CONFLICT (id) DO NOTHING`,
+	insertSession: `INSERT INTO %[1]s (session_key, session_id, data, exp) VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_key, session_id) DO NOTHING`,
+	upsert: `INSERT INTO %[1]s_records (record_key, data, exp) VALUES (?, ?, ?)
+		ON CONFLICT (record_key) DO UPDATE SET data = EXCLUDED.data, exp = EXCLUDED.exp`,
+}
+
+// MySQL is the dialect for MySQL 5.7 and later, and MariaDB.  Keys are
+// limited to 512 bytes; see jeff.MapKey for storing longer ones.  MySQL
+// commits before each schema change, so the migrations are written to be safe
+// to run more than once.
+var MySQL = Dialect{
+	placeholder: question,
+	migrations: []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s (
+			session_key VARBINARY(512) NOT NULL,
+			session_id VARBINARY(64) NOT NULL,
+			data LONGBLOB NOT NULL,
+			exp BIGINT NOT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (session_key, session_id),
+			INDEX %[1]s_exp (exp)
+		)`,
+		`CREATE TABLE IF NOT EXISTS %[1]s_records (
+			record_key VARBINARY(512) PRIMARY KEY,
+			data LONGBLOB NOT NULL,
+			exp BIGINT NOT NULL,
+			INDEX %[1]s_records_exp (exp)
+		)`,
+	},
+	lock:          `SELECT GET_LOCK(?, -1)`,
+	unlock:        `SELECT RELEASE_LOCK(?)`,
+	insertVersion: `INSERT IGNORE INTO %[1]s_version (id, version) VALUES (1, 0)`,
+	insertSession: `INSERT IGNORE INTO %[1]s (session_key, session_id, data, exp) VALUES (?, ?, ?, ?)`,
+	upsert: `INSERT INTO %[1]s_records (record_key, data, exp) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE data = VALUES(data), exp = VALUES(exp)`,
+}
+
+// Store satisfies the jeff.Storage and jeff.SessionStorage interfaces.  Each
+// session is kept in a row of its own, along with the time it expires at.
+// Jeff's other records, such as the lookups of opaque tokens, are kept in a
+// table named after it with a _records suffix.
+type Store struct {
+	db    *sql.DB
+	d     Dialect
+	table string
+}
+
+// New initializes a new database/sql Storage for jeff.  The schema must be
+// created with Migrate before use.
+func New(db *sql.DB, d Dialect, opts ...func(*Store)) *Store {
+	s := &Store{db: db, d: d, table: "jeff_sessions"}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// Table sets the name of the table sessions are stored in.  It defaults to
+// jeff_sessions.  The name is used in queries as is, so it must not come from
+// untrusted input.
+func Table(name string) func(*Store) {
+	return func(s *Store) {
+		s.table = name
+	}
+}
+
+// q returns the query with the table name and placeholders filled in.
+func (s *Store) q(query string) string {
+	query = fmt.Sprintf(query, s.table)
+	if s.d.placeholder(1) == "?" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(s.d.placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Migrate creates the tables sessions are stored in, or brings them up to
+// date.  The version of the schema is kept in a single row of a table named
+// after the sessions table with a _version suffix.  Migrations take an
+// advisory lock on PostgreSQL and MySQL, and SQLite's write lock, before
+// creating any tables, so it's safe to call on every start, from any number
+// of processes at once.
+func (s *Store) Migrate(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if s.d.lock != "" {
+		id := s.lockID()
+		if _, err := conn.ExecContext(ctx, s.q(s.d.lock), id); err != nil {
+			return err
+		}
+		// The lock belongs to the connection, which goes back to the pool,
+		// so release it even if ctx is done.
+		defer conn.ExecContext(context.Background(), s.q(s.d.unlock), id)
+	}
+	_, err = conn.ExecContext(ctx, s.q(`CREATE TABLE IF NOT EXISTS %[1]s_version (
+		id INTEGER PRIMARY KEY,
+		version INTEGER NOT NULL
+	)`))
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, s.q(s.d.insertVersion)); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The no-op update locks the row until the transaction ends.  On SQLite,
+	// it takes the database's write lock, so other processes wait here until
+	// this one is done.
+	if _, err := tx.ExecContext(ctx, s.q(`UPDATE %[1]s_version SET version = version WHERE id = 1`)); err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, s.q(`SELECT version FROM %[1]s_version WHERE id = 1`)).Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(s.d.migrations); version++ {
+		if _, err := tx.ExecContext(ctx, s.q(s.d.migrations[version])); err != nil {
+			return fmt.Errorf("migrating %s to version %d: %w", s.table, version+1, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, s.q(`UPDATE %[1]s_version SET version = ? WHERE id = 1`), version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockID returns the number of the advisory lock taken by Migrate, derived
+// from the table name so that stores using different tables don't wait for
+// each other.
+func (s *Store) lockID() int64 {
+	h := fnv.New64a()
+	h.Write([]byte("jeff:migrate:" + s.table))
+	return int64(h.Sum64())
+}
+
+// FetchSessions satisfies the jeff.SessionStorage.FetchSessions method
+func (s *Store) FetchSessions(ctx context.Context, key []byte) (jeff.SessionList, error) {
+	rows, err := s.sessions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var sl jeff.SessionList
+	for _, r := range rows {
+		sl = append(sl, r.s)
+	}
+	return sl, nil
+}
+
+type row struct {
+	s       jeff.Session
+	data    []byte
+	version int64
+}
+
+// sessions returns the unexpired sessions for key, oldest first.
+func (s *Store) sessions(ctx context.Context, key []byte) ([]row, error) {
+	rs, err := s.db.QueryContext(ctx,
+		s.q(`SELECT data, version FROM %[1]s WHERE session_key = ? AND exp > ? ORDER BY session_id`),
+		key, now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var rows []row
+	for rs.Next() {
+		var r row
+		if err := rs.Scan(&r.data, &r.version); err != nil {
+			return nil, err
+		}
+		if _, err := r.s.UnmarshalMsg(r.data); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rows, func(i, k int) bool {
+		return rows[i].s.Created.Before(rows[k].s.Created)
+	})
+	return rows, nil
+}
+
+// UpdateSessions satisfies the jeff.SessionStorage.UpdateSessions method.
+// Only the rows of the sessions fn adds, changes or removes are written, each
+// only if its version is still the one read, retrying otherwise.  Sessions
+// added concurrently are left alone.
+func (s *Store) UpdateSessions(ctx context.Context, key []byte, fn func(jeff.SessionList) jeff.SessionList) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, err := s.sessions(ctx, key)
+		if err != nil {
+			return err
+		}
+		sl := make(jeff.SessionList, len(rows))
+		for i, r := range rows {
+			sl[i] = r.s
+		}
+		ok, err := s.apply(ctx, key, rows, fn(sl))
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+// apply writes the changes from rows to sl in a transaction.  It returns false
+// if one of the rows was modified since it was read.
+func (s *Store) apply(ctx context.Context, key []byte, rows []row, sl jeff.SessionList) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	exec := func(query string, args ...interface{}) (bool, error) {
+		res, err := tx.ExecContext(ctx, s.q(query), args...)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+
+	old := make(map[string]row, len(rows))
+	for _, r := range rows {
+		old[string(r.s.Token)] = r
+	}
+	for _, sess := range sl {
+		data, err := sess.MarshalMsg(nil)
+		if err != nil {
+			return false, err
+		}
+		r, exists := old[string(sess.Token)]
+		delete(old, string(sess.Token))
+		var ok bool
+		switch {
+		case !exists:
+			// The insert does nothing if another writer created the row in
+			// the meantime.
+			ok, err = exec(s.d.insertSession, key, sess.Token, data, sess.Exp.UnixNano())
+		case bytes.Equal(data, r.data):
+			continue
+		default:
+			ok, err = exec(`UPDATE %[1]s SET data = ?, exp = ?, version = version + 1
+				WHERE session_key = ? AND session_id = ? AND version = ?`,
+				data, sess.Exp.UnixNano(), key, sess.Token, r.version)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, r := range old {
+		ok, err := exec(`DELETE FROM %[1]s WHERE session_key = ? AND session_id = ? AND version = ?`,
+			key, r.s.Token, r.version)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// Store satisfies the jeff.Store.Store method
+func (s *Store) Store(ctx context.Context, key, value []byte, exp time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.q(s.d.upsert), key, value, exp.UnixNano())
+	return err
+}
+
+// Fetch satisfies the jeff.Store.Fetch method
+func (s *Store) Fetch(ctx context.Context, key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT data FROM %[1]s_records WHERE record_key = ? AND exp > ?`),
+		key, now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Delete satisfies the jeff.Store.Delete method.  It deletes the sessions
+// stored for key as well as the record.
+func (s *Store) Delete(ctx context.Context, key []byte) error {
+	_, err := s.db.ExecContext(ctx, s.q(`DELETE FROM %[1]s WHERE session_key = ?`), key)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.q(`DELETE FROM %[1]s_records WHERE record_key = ?`), key)
+	return err
+}
+
+// Sweep deletes the sessions and records which have expired, returning how
+// many there were.  Expired rows are never returned by Fetch or
+// FetchSessions, so sweeping only reclaims space.
+func (s *Store) Sweep(ctx context.Context) (int64, error) {
+	var total int64
+	for _, table := range []string{"%[1]s", "%[1]s_records"} {
+		res, err := s.db.ExecContext(ctx, s.q(`DELETE FROM `+table+` WHERE exp <= ?`), now().UnixNano())
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// SweepEvery calls Sweep at the given interval until ctx is done.  Errors are
+// passed to onError, if it's not nil, and don't stop the sweeper.
+//
+//	go store.SweepEvery(ctx, time.Hour, func(err error) { log.Print(err) })
+func (s *Store) SweepEvery(ctx context.Context, every time.Duration, onError func(error)) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := s.Sweep(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
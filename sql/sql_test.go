@@ -0,0 +1,176 @@
+package sql_store_test
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abraithwaite/jeff"
+	"github.com/abraithwaite/jeff/internal/storetest"
+	sql_store "github.com/abraithwaite/jeff/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db := storetest.SQLiteDB(t)
+	str := sql_store.New(db, sql_store.SQLite, sql_store.Table("sessions"))
+	require.NoError(t, str.Migrate(ctx))
+	require.NoError(t, str.Migrate(ctx), "migrating twice should be a no-op")
+
+	var version int
+	require.NoError(t, db.QueryRow("SELECT version FROM sessions_version").Scan(&version))
+	assert.Equal(t, 4, version)
+	require.NoError(t, str.Store(ctx, []byte("key"), []byte("value"), time.Now().Add(time.Hour)))
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sessions_records").Scan(&n))
+	assert.Equal(t, 1, n, "table option should name the tables")
+}
+
+func TestMigrateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	dsn := "file:" + filepath.Join(storetest.TempDir(t), "sessions.db") + "?_busy_timeout=10000"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		db, err := sql.Open("sqlite3", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sql_store.New(db, sql_store.SQLite).Migrate(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM jeff_sessions_version").Scan(&n))
+	assert.Equal(t, 1, n, "there should be a single version row")
+}
+
+func TestSessionRows(t *testing.T) {
+	ctx := context.Background()
+	db := storetest.SQLiteDB(t)
+	db.SetMaxOpenConns(1)
+	str := sql_store.New(db, sql_store.SQLite)
+	require.NoError(t, str.Migrate(ctx))
+	j := jeff.New(str, jeff.Opaque)
+	key := []byte("alice@example.com")
+	require.NoError(t, j.Set(ctx, httptest.NewRecorder(), key))
+	require.NoError(t, j.Set(ctx, httptest.NewRecorder(), key, []byte("laptop")))
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM jeff_sessions WHERE session_key = ?", key).Scan(&n))
+	assert.Equal(t, 2, n, "each session should have a row")
+	sl, err := j.SessionsForKey(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sl))
+	assert.Equal(t, []byte("laptop"), sl[1].Meta, "sessions should be listed oldest first")
+
+	require.NoError(t, j.Delete(ctx, key, sl[0].Token))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM jeff_sessions").Scan(&n))
+	assert.Equal(t, 1, n, "deleting a session should delete its row")
+	require.NoError(t, j.Delete(ctx, key))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM jeff_sessions").Scan(&n))
+	assert.Equal(t, 0, n, "deleting a key should delete all its rows")
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	db := storetest.SQLiteDB(t)
+	str := sql_store.New(db, sql_store.SQLite)
+	require.NoError(t, str.Migrate(ctx))
+	require.NoError(t, str.Store(ctx, []byte("old"), []byte("value"), time.Now().Add(-time.Second)))
+	require.NoError(t, str.Store(ctx, []byte("new"), []byte("value"), time.Now().Add(time.Hour)))
+	key := []byte("key")
+	require.NoError(t, str.UpdateSessions(ctx, key, func(jeff.SessionList) jeff.SessionList {
+		return jeff.SessionList{
+			{Key: key, Token: []byte("old"), Exp: time.Now().Add(-time.Second)},
+			{Key: key, Token: []byte("new"), Exp: time.Now().Add(time.Hour)},
+		}
+	}))
+
+	v, err := str.Fetch(ctx, []byte("old"))
+	require.NoError(t, err)
+	assert.Nil(t, v, "expired records shouldn't be fetched")
+	sl, err := str.FetchSessions(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl), "expired sessions shouldn't be fetched")
+
+	n, err := str.Sweep(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	v, err = str.Fetch(ctx, []byte("new"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), v, "unexpired records should be kept")
+	sl, err = str.FetchSessions(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(sl), "unexpired sessions should be kept")
+}
+
+func TestUpdateConflict(t *testing.T) {
+	ctx := context.Background()
+	str := sql_store.New(storetest.SQLiteDB(t), sql_store.SQLite)
+	require.NoError(t, str.Migrate(ctx))
+	key, exp := []byte("key"), time.Now().Add(time.Hour)
+	set := func(meta string, tokens ...string) {
+		require.NoError(t, str.UpdateSessions(ctx, key, func(sl jeff.SessionList) jeff.SessionList {
+			for _, tok := range tokens {
+				sl = append(sl, jeff.Session{Key: key, Token: []byte(tok), Meta: []byte(meta), Exp: exp})
+			}
+			return sl
+		}))
+	}
+	set("", "a")
+
+	var calls int
+	err := str.UpdateSessions(ctx, key, func(sl jeff.SessionList) jeff.SessionList {
+		calls++
+		if calls == 1 {
+			// Another writer gets in between the read and the write.
+			require.NoError(t, str.UpdateSessions(ctx, key, func(sl jeff.SessionList) jeff.SessionList {
+				sl[0].Meta = []byte("x")
+				return sl
+			}))
+			set("", "b")
+		}
+		for i := range sl {
+			sl[i].Meta = append(sl[i].Meta, 'y')
+		}
+		return sl
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls, "conflicting update should be retried")
+	sl, err := str.FetchSessions(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(sl))
+	assert.Equal(t, []byte("xy"), sl[0].Meta)
+
+	calls = 0
+	err = str.UpdateSessions(ctx, key, func(sl jeff.SessionList) jeff.SessionList {
+		calls++
+		if calls == 1 {
+			set("", "c")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls, "sessions added concurrently shouldn't conflict")
+	sl, err = str.FetchSessions(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(sl), "sessions added concurrently should be kept")
+	assert.Equal(t, []byte("c"), sl[0].Token)
+}
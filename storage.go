@@ -1,9 +1,11 @@
 package jeff
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/subtle"
-	"errors"
+	"encoding/hex"
 	"time"
 )
 
@@ -25,40 +27,257 @@ type Storage interface {
 	Delete(ctx context.Context, key []byte) error
 }
 
+// Updater is an optional interface a Storage can implement to provide an
+// atomic read-modify-write of the value stored under a key.  When the Storage
+// implements it, Jeff uses Update for every change to a SessionList instead of
+// a Fetch followed by a Store, so that concurrent logins and logouts for the
+// same key don't overwrite each other.
+type Updater interface {
+	// Update calls fn with the current value for key and atomically replaces
+	// it with the value and expiration returned.  If fn returns a nil value,
+	// the key is deleted instead.  Expired or missing keys must be passed to
+	// fn as a nil value.  If fn returns an error, the value is left untouched
+	// and the error is returned to the caller.  fn may be called more than
+	// once if the value is modified concurrently, so it must not have side
+	// effects.
+	Update(ctx context.Context, key []byte, fn func(value []byte) ([]byte, time.Time, error)) error
+}
+
+// SessionStorage is an optional interface a Storage can implement to keep
+// each session separately, such as in a row per session, instead of the whole
+// SessionList of a key as one value.  When the Storage implements it, Jeff
+// reads and writes SessionLists only through it.  Jeff's other records, such
+// as the lookups of Opaque tokens, still go through Store and Fetch, and
+// Delete must remove the sessions for the key as well.
+type SessionStorage interface {
+	// FetchSessions returns the unexpired sessions stored for key.
+	FetchSessions(ctx context.Context, key []byte) (SessionList, error)
+	// UpdateSessions calls fn with the unexpired sessions stored for key and
+	// atomically replaces them with the sessions it returns, each of which
+	// expires at its Exp.  Sessions are identified by their Token.  fn may be
+	// called more than once if the sessions are modified concurrently, so it
+	// must not have side effects.
+	UpdateSessions(ctx context.Context, key []byte, fn func(SessionList) SessionList) error
+}
+
+// reservedPrefix starts the keys of the records Jeff keeps in the Storage
+// besides SessionLists, such as the lookups of opaque tokens.
+const reservedPrefix = "jeff:"
+
+// escapedPrefix is prepended to session keys starting with reservedPrefix, so
+// that no session key can be stored under the key of one of Jeff's records.
+// No record key starts with it.
+const escapedPrefix = reservedPrefix + "key:"
+
+// storageKey maps a session key to the key its SessionList is stored under in
+// the Storage.
+func (j *Jeff) storageKey(key []byte) []byte {
+	if bytes.HasPrefix(key, []byte(reservedPrefix)) {
+		key = append([]byte(escapedPrefix), key...)
+	}
+	return j.recordKey(key)
+}
+
+// recordKey maps the key of one of Jeff's records to the key it's stored
+// under in the Storage.
+func (j *Jeff) recordKey(key []byte) []byte {
+	if j.mapKey == nil {
+		return key
+	}
+	return j.mapKey(key)
+}
+
+// idPrefix namespaces the lookups from opaque tokens to session keys in the
+// Storage.
+const idPrefix = reservedPrefix + "id:"
+
+// idKey returns the storage key of the lookup for an opaque token.  The token
+// is hashed so that the backend's keyspace doesn't reveal live tokens.
+func idKey(tok string) []byte {
+	return digestIDKey(digest([]byte(tok)))
+}
+
+// digestIDKey returns the storage key of the lookup for an opaque token from
+// its digest, as stored in Session.Token.
+func digestIDKey(d []byte) []byte {
+	return []byte(idPrefix + hex.EncodeToString(d))
+}
+
+// link stores the lookup from an opaque token to its session key.
+func (j *Jeff) link(ctx context.Context, key []byte, tok string, exp time.Time) error {
+	return storageErr(j.s.Store(ctx, j.recordKey(idKey(tok)), key, exp))
+}
+
+// relink moves the expiration of the lookups of the sessions' opaque tokens
+// to the sessions' expiration.  Sessions without a lookup are skipped, so it
+// works whether or not they were issued with Opaque.
+func (j *Jeff) relink(ctx context.Context, sl SessionList) error {
+	for _, s := range sl {
+		id := j.recordKey(digestIDKey(s.Token))
+		key, err := j.s.Fetch(ctx, id)
+		if err != nil {
+			return storageErr(err)
+		}
+		if key == nil {
+			continue
+		}
+		if err := j.s.Store(ctx, id, key, s.Exp); err != nil {
+			return storageErr(err)
+		}
+	}
+	return nil
+}
+
+// lookup returns the session key an opaque token was issued for.
+func (j *Jeff) lookup(ctx context.Context, tok string) ([]byte, error) {
+	key, err := j.s.Fetch(ctx, j.recordKey(idKey(tok)))
+	if err != nil {
+		return nil, storageErr(err)
+	}
+	if key == nil {
+		return nil, ErrSessionNotFound
+	}
+	return key, nil
+}
+
+// loadOne returns the session for key with the token tok, following the
+// forwarding pointers left by RenameKey.  The session's Key is the one it's
+// stored under now.
 func (j *Jeff) loadOne(ctx context.Context, key, tok []byte) (Session, error) {
+	return j.loadHops(ctx, key, tok, maxForwards)
+}
+
+func (j *Jeff) loadHops(ctx context.Context, key, tok []byte, hops int) (Session, error) {
 	l, err := j.load(ctx, key)
 	if err != nil {
 		return Session{}, err
 	}
-	s, i := find(l, tok)
+	s, i := match(l, digest(tok))
+	if i >= 0 {
+		if s.Exp.Before(now()) {
+			return Session{}, ErrSessionExpired
+		}
+		return j.valid(ctx, s)
+	}
+	s, i, latest := findRotated(l, digest(tok))
 	if i < 0 {
-		return Session{}, errors.New("session not found")
+		return j.forward(ctx, key, tok, hops)
+	}
+	if latest && now().Before(s.Issued.Add(j.grace)) {
+		return j.valid(ctx, s)
+	}
+	// A rotated-out token showing up after the grace window means someone
+	// else holds a copy of it.  Revoke the session so neither party keeps it.
+	if err := j.clear(ctx, key, tok); err != nil {
+		return Session{}, err
+	}
+	return Session{}, ErrTokenReused
+}
+
+// valid returns s unless it has been invalidated by InvalidateBefore or
+// InvalidateAllBefore, which is only checked with the Epochs option.
+func (j *Jeff) valid(ctx context.Context, s Session) (Session, error) {
+	if !j.epochs {
+		return s, nil
+	}
+	if err := j.checkEpochs(ctx, s); err != nil {
+		return Session{}, err
 	}
 	return s, nil
 }
 
 func (j *Jeff) load(ctx context.Context, key []byte) (SessionList, error) {
-	stored, err := j.s.Fetch(ctx, key)
-	if err != nil || stored == nil {
-		return nil, err
+	if ss, ok := j.s.(SessionStorage); ok {
+		sl, err := ss.FetchSessions(ctx, j.storageKey(key))
+		return sl, storageErr(err)
+	}
+	stored, err := j.s.Fetch(ctx, j.storageKey(key))
+	if err != nil {
+		return nil, storageErr(err)
+	}
+	sl, err := decodeList(stored)
+	return sl, storageErr(err)
+}
+
+func decodeList(stored []byte) (SessionList, error) {
+	if stored == nil {
+		return nil, nil
 	}
 	var sl SessionList
-	_, err = sl.UnmarshalMsg(stored)
+	_, err := sl.UnmarshalMsg(stored)
+	for i := range sl {
+		if !sl[i].Hashed {
+			sl[i] = upgrade(sl[i])
+		}
+	}
 	return sl, err
 }
 
+// upgrade replaces the plaintext tokens of a session stored by an older
+// version with their digests.  The stored list is rewritten on its next
+// update.
+func upgrade(s Session) Session {
+	s.Token = digest(s.Token)
+	prev := make([][]byte, len(s.Prev))
+	for i, p := range s.Prev {
+		prev[i] = digest(p)
+	}
+	s.Prev = prev
+	s.Hashed = true
+	return s
+}
+
+// digest returns the form a token is stored in.
+func digest(tok []byte) []byte {
+	sum := sha256.Sum256(tok)
+	return sum[:]
+}
+
 func find(l SessionList, k []byte) (Session, int) {
+	s, i := match(l, k)
+	if i < 0 || s.Exp.Before(now()) {
+		return Session{}, -1
+	}
+	return s, i
+}
+
+// match finds the session with token k, whether or not it has expired.
+func match(l SessionList, k []byte) (Session, int) {
 	for i, s := range l {
 		if subtle.ConstantTimeCompare(s.Token, k) == 1 {
-			if s.Exp.Before(now()) {
-				break
-			}
 			return s, i
 		}
 	}
 	return Session{}, -1
 }
 
+// selected reports whether s has one of tokens, given as handed to the client
+// or as stored.
+func selected(s Session, tokens [][]byte) bool {
+	for _, tok := range tokens {
+		if subtle.ConstantTimeCompare(s.Token, digest(tok)) == 1 || subtle.ConstantTimeCompare(s.Token, tok) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// findRotated finds the unexpired session which previously had the token k,
+// and reports whether k is the token it was most recently rotated from.
+func findRotated(l SessionList, k []byte) (Session, int, bool) {
+	for i, s := range l {
+		for n, p := range s.Prev {
+			if subtle.ConstantTimeCompare(p, k) == 1 {
+				if s.Exp.Before(now()) {
+					return Session{}, -1, false
+				}
+				return s, i, n == 0
+			}
+		}
+	}
+	return Session{}, -1, false
+}
+
 func prune(l SessionList) SessionList {
 	ret := make(SessionList, 0, len(l))
 	for _, s := range l {
@@ -70,52 +289,171 @@ func prune(l SessionList) SessionList {
 	return ret
 }
 
-func (j *Jeff) store(ctx context.Context, s Session) error {
-	sl, err := j.load(ctx, s.Key)
-	if err != nil {
-		return err
+// update applies fn to the SessionList stored for key and writes back the
+// result.  If the Storage implements SessionStorage or Updater, this happens
+// atomically.  Otherwise it falls back to a plain read-modify-write, which may
+// lose concurrent updates.
+//
+// The list is kept in the backend for as long as its longest-lived session,
+// and is deleted once no unexpired sessions remain.
+func (j *Jeff) update(ctx context.Context, key []byte, fn func(SessionList) SessionList) error {
+	if ss, ok := j.s.(SessionStorage); ok {
+		return storageErr(ss.UpdateSessions(ctx, j.storageKey(key), func(sl SessionList) SessionList {
+			return prune(fn(sl))
+		}))
+	}
+	modify := func(stored []byte) ([]byte, time.Time, error) {
+		sl, err := decodeList(stored)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		sl = prune(fn(sl))
+		if len(sl) == 0 {
+			return nil, time.Time{}, nil
+		}
+		bts, err := sl.MarshalMsg(nil)
+		return bts, latest(sl), err
 	}
-	if _, i := find(sl, s.Token); i >= 0 {
-		sl[i] = s
-	} else {
-		sl = append(sl, s)
+	key = j.storageKey(key)
+	if u, ok := j.s.(Updater); ok {
+		return storageErr(u.Update(ctx, key, modify))
+	}
+	stored, err := j.s.Fetch(ctx, key)
+	if err != nil {
+		return storageErr(err)
 	}
-	sl = prune(sl)
-	bts, err := sl.MarshalMsg(nil)
+	bts, exp, err := modify(stored)
 	if err != nil {
-		return err
+		return storageErr(err)
+	}
+	if bts == nil {
+		return storageErr(j.s.Delete(ctx, key))
+	}
+	return storageErr(j.s.Store(ctx, key, bts, exp))
+}
+
+// latest returns the expiration of the longest-lived session in the list.
+func latest(l SessionList) time.Time {
+	var exp time.Time
+	for _, s := range l {
+		if s.Exp.After(exp) {
+			exp = s.Exp
+		}
+	}
+	return exp
+}
+
+func (j *Jeff) store(ctx context.Context, s Session) error {
+	return j.update(ctx, s.Key, func(sl SessionList) SessionList {
+		if _, i := find(sl, s.Token); i >= 0 {
+			sl[i] = s
+		} else {
+			sl = append(sl, s)
+		}
+		return sl
+	})
+}
+
+// extend sets the expiration of the stored session matching s.Token to s.Exp.
+// Sessions which were removed in the meantime are not brought back, and
+// ErrSessionNotFound is returned instead.
+func (j *Jeff) extend(ctx context.Context, s Session) error {
+	var found bool
+	err := j.update(ctx, s.Key, func(sl SessionList) SessionList {
+		_, i := find(sl, s.Token)
+		if found = i >= 0; found {
+			sl[i].Exp = s.Exp
+		}
+		return sl
+	})
+	if err == nil && !found {
+		err = ErrSessionNotFound
 	}
-	// Global Expiration 30d, TODO: make configurable
-	return j.s.Store(ctx, s.Key, bts, now().Add(24*30*time.Hour))
+	return err
+}
+
+// touch records s.LastSeen in the background.  Only one write per session is
+// in flight at a time, so a slow backend doesn't pile up goroutines.
+func (j *Jeff) touch(s Session) {
+	id := string(s.Token)
+	if _, busy := j.touching.LoadOrStore(id, struct{}{}); busy {
+		return
+	}
+	go func() {
+		defer j.touching.Delete(id)
+		// The request's context may be done by now; a lost update is retried
+		// by the next request.
+		_ = j.update(context.Background(), s.Key, func(sl SessionList) SessionList {
+			if _, i := find(sl, s.Token); i >= 0 && sl[i].LastSeen.Before(s.LastSeen) {
+				sl[i].LastSeen = s.LastSeen
+			}
+			return sl
+		})
+	}()
+}
+
+// rotate replaces the token of the stored session matching s.Token with the
+// digest of tok, keeping the old one in Prev.
+func (j *Jeff) rotate(ctx context.Context, s Session, tok []byte) (Session, error) {
+	var found bool
+	err := j.update(ctx, s.Key, func(sl SessionList) SessionList {
+		_, i := find(sl, s.Token)
+		if found = i >= 0; !found {
+			return sl
+		}
+		prev := append([][]byte{sl[i].Token}, sl[i].Prev...)
+		if len(prev) > rotationHistory {
+			prev = prev[:rotationHistory]
+		}
+		sl[i].Token = digest(tok)
+		sl[i].Issued = now()
+		sl[i].Prev = prev
+		s = sl[i]
+		return sl
+	})
+	if err == nil && !found {
+		err = ErrSessionNotFound
+	}
+	return s, err
+}
+
+// revokeOthers deletes every session for key other than the one with the
+// token keep, given as handed to the client or as stored.
+func (j *Jeff) revokeOthers(ctx context.Context, key, keep []byte) error {
+	return j.update(ctx, key, func(sl SessionList) SessionList {
+		for _, d := range [][]byte{digest(keep), keep} {
+			if s, i := find(sl, d); i >= 0 {
+				return SessionList{s}
+			}
+		}
+		return nil
+	})
 }
 
 // Clear deletes all sessions for a given key, or it deletes the selected
 // sessions if a list of tokens is given.
 func (j *Jeff) clear(ctx context.Context, key []byte, tokens ...[]byte) error {
 	if len(tokens) == 0 {
-		return j.s.Delete(ctx, key)
-	}
-
-	sl, err := j.load(ctx, key)
-	if err != nil {
-		return err
+		return storageErr(j.s.Delete(ctx, j.storageKey(key)))
 	}
 
 	// if it's found, remove it.  This is O(N**2).  Not sure what the best way
 	// to avoid this is.  Might want to impose limits on the number of sessions
 	// per user and tokens passed into clear.
-	for _, tok := range tokens {
-		if _, i := find(sl, tok); i >= 0 {
-			sl = append(sl[:i], sl[i+1:]...)
+	//
+	// Tokens may be given as handed to the client, or as stored, which is how
+	// SessionsForKey and ActiveSession return them.
+	return j.update(ctx, key, func(sl SessionList) SessionList {
+		for _, tok := range tokens {
+			for _, d := range [][]byte{digest(tok), tok} {
+				if _, i := find(sl, d); i >= 0 {
+					sl = append(sl[:i], sl[i+1:]...)
+				} else if _, i, _ := findRotated(sl, d); i >= 0 {
+					// Tokens a session was rotated from also identify it.
+					sl = append(sl[:i], sl[i+1:]...)
+				}
+			}
 		}
-	}
-
-	// prune expired sessions
-	sl = prune(sl)
-	bts, err := sl.MarshalMsg(nil)
-	if err != nil {
-		return err
-	}
-	// Global Expiration 30d, TODO: make configurable
-	return j.s.Store(ctx, key, bts, now().Add(24*30*time.Hour))
+		return sl
+	})
 }
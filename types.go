@@ -1,15 +1,51 @@
 //go:generate msgp
 package jeff
 
-import "time"
+import (
+	"encoding/hex"
+	"time"
+)
 
 // Session represents the Session as it's stored in serialized form.  It's the
 // object that gets returned to the caller when checking a session.
 type Session struct {
-	Key   []byte    `msg:"key"`
+	Key []byte `msg:"key"`
+	// Token is the SHA-256 digest of the token handed to the client, so that
+	// reading the backend isn't enough to hijack a session.
 	Token []byte    `msg:"token"`
 	Meta  []byte    `msg:"meta"`
 	Exp   time.Time `msg:"exp"`
+	// MaxExp is the absolute expiration of the session, past which it can't
+	// be renewed.  It's zero if no MaxLifetime was configured.
+	MaxExp time.Time `msg:"max_exp"`
+	// Issued is when Token was issued, either at login or when the session
+	// was last rotated.
+	Issued time.Time `msg:"issued"`
+	// Prev holds the tokens the session was previously known by, most recent
+	// first.  They're kept to detect reuse of rotated-out tokens.
+	Prev [][]byte `msg:"prev"`
+	// Hashed is set once Token and Prev hold digests.  Sessions stored by
+	// older versions hold the tokens themselves and are hashed on load.
+	Hashed bool `msg:"hashed"`
+	// CSRF is the secret CSRF tokens for the session are derived from.
+	CSRF []byte `msg:"csrf"`
+	// Created is when the session was started with Set or Issue.  It's zero
+	// for sessions stored by older versions.
+	Created time.Time `msg:"created"`
+	// IP, UserAgent and Device describe the client which started the
+	// session.  See WithClient and WithDevice.
+	IP        string `msg:"ip"`
+	UserAgent string `msg:"ua"`
+	Device    string `msg:"device"`
+	// LastSeen is roughly when the session was last used.  It's only kept up
+	// to date with TrackLastSeen.
+	LastSeen time.Time `msg:"last_seen"`
+}
+
+// ID returns a short identifier for the session, for referring to it in user
+// interfaces and APIs without revealing its token.
+func (s Session) ID() string {
+	return hex.EncodeToString(digest(s.Token)[:8])
 }
 
 // SessionList is a list of active sessions for a given key
@@ -42,6 +42,68 @@ func (z *Session) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "max_exp":
+			z.MaxExp, err = dc.ReadTime()
+			if err != nil {
+				return
+			}
+		case "issued":
+			z.Issued, err = dc.ReadTime()
+			if err != nil {
+				return
+			}
+		case "prev":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				return
+			}
+			if cap(z.Prev) >= int(zb0002) {
+				z.Prev = (z.Prev)[:zb0002]
+			} else {
+				z.Prev = make([][]byte, zb0002)
+			}
+			for za0001 := range z.Prev {
+				z.Prev[za0001], err = dc.ReadBytes(z.Prev[za0001])
+				if err != nil {
+					return
+				}
+			}
+		case "hashed":
+			z.Hashed, err = dc.ReadBool()
+			if err != nil {
+				return
+			}
+		case "csrf":
+			z.CSRF, err = dc.ReadBytes(z.CSRF)
+			if err != nil {
+				return
+			}
+		case "created":
+			z.Created, err = dc.ReadTime()
+			if err != nil {
+				return
+			}
+		case "ip":
+			z.IP, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "ua":
+			z.UserAgent, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "device":
+			z.Device, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "last_seen":
+			z.LastSeen, err = dc.ReadTime()
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -54,9 +116,9 @@ func (z *Session) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Session) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 4
+	// map header, size 14
 	// write "key"
-	err = en.Append(0x84, 0xa3, 0x6b, 0x65, 0x79)
+	err = en.Append(0x8e, 0xa3, 0x6b, 0x65, 0x79)
 	if err != nil {
 		return
 	}
@@ -91,15 +153,111 @@ func (z *Session) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "max_exp"
+	err = en.Append(0xa7, 0x6d, 0x61, 0x78, 0x5f, 0x65, 0x78, 0x70)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.MaxExp)
+	if err != nil {
+		return
+	}
+	// write "issued"
+	err = en.Append(0xa6, 0x69, 0x73, 0x73, 0x75, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.Issued)
+	if err != nil {
+		return
+	}
+	// write "prev"
+	err = en.Append(0xa4, 0x70, 0x72, 0x65, 0x76)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Prev)))
+	if err != nil {
+		return
+	}
+	for za0001 := range z.Prev {
+		err = en.WriteBytes(z.Prev[za0001])
+		if err != nil {
+			return
+		}
+	}
+	// write "hashed"
+	err = en.Append(0xa6, 0x68, 0x61, 0x73, 0x68, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Hashed)
+	if err != nil {
+		return
+	}
+	// write "csrf"
+	err = en.Append(0xa4, 0x63, 0x73, 0x72, 0x66)
+	if err != nil {
+		return
+	}
+	err = en.WriteBytes(z.CSRF)
+	if err != nil {
+		return
+	}
+	// write "created"
+	err = en.Append(0xa7, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.Created)
+	if err != nil {
+		return
+	}
+	// write "ip"
+	err = en.Append(0xa2, 0x69, 0x70)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.IP)
+	if err != nil {
+		return
+	}
+	// write "ua"
+	err = en.Append(0xa2, 0x75, 0x61)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.UserAgent)
+	if err != nil {
+		return
+	}
+	// write "device"
+	err = en.Append(0xa6, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Device)
+	if err != nil {
+		return
+	}
+	// write "last_seen"
+	err = en.Append(0xa9, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x73, 0x65, 0x65, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.LastSeen)
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Session) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 4
+	// map header, size 14
 	// string "key"
-	o = append(o, 0x84, 0xa3, 0x6b, 0x65, 0x79)
+	o = append(o, 0x8e, 0xa3, 0x6b, 0x65, 0x79)
 	o = msgp.AppendBytes(o, z.Key)
 	// string "token"
 	o = append(o, 0xa5, 0x74, 0x6f, 0x6b, 0x65, 0x6e)
@@ -110,6 +268,39 @@ func (z *Session) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "exp"
 	o = append(o, 0xa3, 0x65, 0x78, 0x70)
 	o = msgp.AppendTime(o, z.Exp)
+	// string "max_exp"
+	o = append(o, 0xa7, 0x6d, 0x61, 0x78, 0x5f, 0x65, 0x78, 0x70)
+	o = msgp.AppendTime(o, z.MaxExp)
+	// string "issued"
+	o = append(o, 0xa6, 0x69, 0x73, 0x73, 0x75, 0x65, 0x64)
+	o = msgp.AppendTime(o, z.Issued)
+	// string "prev"
+	o = append(o, 0xa4, 0x70, 0x72, 0x65, 0x76)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Prev)))
+	for za0001 := range z.Prev {
+		o = msgp.AppendBytes(o, z.Prev[za0001])
+	}
+	// string "hashed"
+	o = append(o, 0xa6, 0x68, 0x61, 0x73, 0x68, 0x65, 0x64)
+	o = msgp.AppendBool(o, z.Hashed)
+	// string "csrf"
+	o = append(o, 0xa4, 0x63, 0x73, 0x72, 0x66)
+	o = msgp.AppendBytes(o, z.CSRF)
+	// string "created"
+	o = append(o, 0xa7, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64)
+	o = msgp.AppendTime(o, z.Created)
+	// string "ip"
+	o = append(o, 0xa2, 0x69, 0x70)
+	o = msgp.AppendString(o, z.IP)
+	// string "ua"
+	o = append(o, 0xa2, 0x75, 0x61)
+	o = msgp.AppendString(o, z.UserAgent)
+	// string "device"
+	o = append(o, 0xa6, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65)
+	o = msgp.AppendString(o, z.Device)
+	// string "last_seen"
+	o = append(o, 0xa9, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x73, 0x65, 0x65, 0x6e)
+	o = msgp.AppendTime(o, z.LastSeen)
 	return
 }
 
@@ -149,6 +340,68 @@ func (z *Session) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			if err != nil {
 				return
 			}
+		case "max_exp":
+			z.MaxExp, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				return
+			}
+		case "issued":
+			z.Issued, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				return
+			}
+		case "prev":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				return
+			}
+			if cap(z.Prev) >= int(zb0002) {
+				z.Prev = (z.Prev)[:zb0002]
+			} else {
+				z.Prev = make([][]byte, zb0002)
+			}
+			for za0001 := range z.Prev {
+				z.Prev[za0001], bts, err = msgp.ReadBytesBytes(bts, z.Prev[za0001])
+				if err != nil {
+					return
+				}
+			}
+		case "hashed":
+			z.Hashed, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				return
+			}
+		case "csrf":
+			z.CSRF, bts, err = msgp.ReadBytesBytes(bts, z.CSRF)
+			if err != nil {
+				return
+			}
+		case "created":
+			z.Created, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				return
+			}
+		case "ip":
+			z.IP, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "ua":
+			z.UserAgent, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "device":
+			z.Device, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "last_seen":
+			z.LastSeen, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -162,7 +415,11 @@ func (z *Session) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Session) Msgsize() (s int) {
-	s = 1 + 4 + msgp.BytesPrefixSize + len(z.Key) + 6 + msgp.BytesPrefixSize + len(z.Token) + 5 + msgp.BytesPrefixSize + len(z.Meta) + 4 + msgp.TimeSize
+	s = 1 + 4 + msgp.BytesPrefixSize + len(z.Key) + 6 + msgp.BytesPrefixSize + len(z.Token) + 5 + msgp.BytesPrefixSize + len(z.Meta) + 4 + msgp.TimeSize + 8 + msgp.TimeSize + 7 + msgp.TimeSize + 5 + msgp.ArrayHeaderSize
+	for za0001 := range z.Prev {
+		s += msgp.BytesPrefixSize + len(z.Prev[za0001])
+	}
+	s += 7 + msgp.BoolSize + 5 + msgp.BytesPrefixSize + len(z.CSRF) + 8 + msgp.TimeSize + 3 + msgp.StringPrefixSize + len(z.IP) + 3 + msgp.StringPrefixSize + len(z.UserAgent) + 7 + msgp.StringPrefixSize + len(z.Device) + 10 + msgp.TimeSize
 	return
 }
 